@@ -0,0 +1,172 @@
+package jqx
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itchyny/gojq"
+)
+
+// Cache keeps decoded files, parsed definitions and compiled queries
+// between runs of [Program], so that they are only redone when they change.
+// The zero value is ready to use, and it is safe for concurrent use.
+// Runs that share a compiled query take turns.
+type Cache struct {
+	mu      sync.Mutex
+	files   map[fileKey]fileData
+	defs    map[string][]*gojq.FuncDef
+	queries map[string]*cachedQuery
+}
+
+type fileKey struct {
+	name    string
+	mode    fileMode
+	size    int64
+	modTime time.Time
+}
+
+// fileMode is how a file is read, as each gives different data.
+type fileMode struct {
+	raw     bool
+	ordered bool
+}
+
+// fileData is the data in a file and, if it was read ordered, the order of its object keys.
+type fileData struct {
+	data  any
+	order *keyOrder
+}
+
+// maxQueries bounds the compiled queries kept by a Cache,
+// as interactive use compiles a new one for every edit.
+const maxQueries = 64
+
+type cachedQuery struct {
+	sync.Mutex
+	state State
+	query FanOut
+}
+
+// file returns the data in file, calling load if it has changed since last time.
+// load also reports whether its result may be reused.
+func (c *Cache) file(name string, file fs.File, mode fileMode, load func() (fileData, bool)) fileData {
+	if c == nil {
+		data, _ := load()
+		return data
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		data, _ := load()
+		return data
+	}
+	key := fileKey{name, mode, info.Size(), info.ModTime()}
+
+	c.mu.Lock()
+	data, ok := c.files[key]
+	c.mu.Unlock()
+	if ok {
+		return data
+	}
+
+	data, reuse := load()
+	if reuse {
+		c.mu.Lock()
+		if c.files == nil {
+			c.files = map[fileKey]fileData{}
+		}
+		maps.DeleteFunc(c.files, func(k fileKey, _ fileData) bool { return k.name == name })
+		c.files[key] = data
+		c.mu.Unlock()
+	}
+	return data
+}
+
+// parse returns the definitions in src.
+func (c *Cache) parse(src string) ([]*gojq.FuncDef, error) {
+	if c == nil {
+		parsed, err := gojq.Parse(src)
+		if err != nil {
+			return nil, err
+		}
+		return parsed.FuncDefs, nil
+	}
+
+	c.mu.Lock()
+	defs, ok := c.defs[src]
+	c.mu.Unlock()
+	if ok {
+		return defs, nil
+	}
+
+	parsed, err := gojq.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.defs == nil {
+		c.defs = map[string][]*gojq.FuncDef{}
+	}
+	c.defs[src] = parsed.FuncDefs
+	c.mu.Unlock()
+	return parsed.FuncDefs, nil
+}
+
+// compile compiles code with state, or reuses a query compiled
+// with the same definitions and names of globals.
+// It returns the state that the query runs with, which has the
+// settings of the given state, and a function to release it when done.
+// As with [State.compileSaves], the query yields the files it saves among its results.
+func (c *Cache) compile(state *State, code string) (*State, FanOut, func(), error) {
+	if c == nil {
+		query, err := state.compileSaves(code)
+		return state, query, func() {}, err
+	}
+
+	var key strings.Builder
+	fmt.Fprintf(&key, "%q %q %q", code, slices.Sorted(maps.Keys(state.Globals)), state.ModulePaths)
+	for _, def := range state.Defs {
+		fmt.Fprintf(&key, " %p", def)
+	}
+
+	c.mu.Lock()
+	if c.queries == nil {
+		c.queries = map[string]*cachedQuery{}
+	}
+	cached, ok := c.queries[key.String()]
+	if !ok {
+		if len(c.queries) >= maxQueries {
+			clear(c.queries)
+		}
+		cached = &cachedQuery{}
+		c.queries[key.String()] = cached
+	}
+	c.mu.Unlock()
+
+	cached.Lock()
+	cached.state.Globals = state.Globals
+	cached.state.Context = state.Context
+	cached.state.Limits = state.Limits
+	cached.state.Files = nil
+	if cached.query == nil {
+		cached.state.ModulePaths = state.ModulePaths
+		cached.state.Defs = state.Defs
+
+		query, err := cached.state.compileSaves(code)
+		if err != nil {
+			cached.Unlock()
+			c.mu.Lock()
+			delete(c.queries, key.String())
+			c.mu.Unlock()
+			return nil, nil, nil, err
+		}
+		cached.query = query
+	}
+
+	return &cached.state, cached.query, cached.Unlock, nil
+}
@@ -0,0 +1,78 @@
+package jqx
+
+import (
+	"fmt"
+	"io/fs"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestCacheFiles(t *testing.T) {
+	fsys := fstest.MapFS{"a.json": &fstest.MapFile{Data: []byte("[1]")}}
+	p := Program{StdinIsTerminal: true, Open: fsys.Open, Cache: &Cache{}}
+
+	p.Args = []string{".[][]", "a.json"}
+	testRun(t, "", "1", &p)
+
+	fsys["a.json"].Data = []byte("[2]")
+	testRun(t, "", "1", &p)
+	p.Args = []string{"-r", ".[]", "a.json"}
+	testRun(t, "", "[2]", &p)
+
+	fsys["a.json"].ModTime = time.Unix(1, 0)
+	p.Args = []string{".[][]", "a.json"}
+	testRun(t, "", "2", &p)
+	assertEqual(t, len(p.Cache.files), 1)
+
+	p.Cache = nil
+	fsys["a.json"].Data = []byte("[3]")
+	testRun(t, "", "3", &p)
+}
+func TestCacheQueries(t *testing.T) {
+	cache := &Cache{}
+	p := Program{Cache: cache, Config: fstest.MapFS{
+		"a.jq": &fstest.MapFile{Data: []byte(`def inc: .+1;`)},
+	}}
+
+	var fsys fs.FS
+	for range 3 {
+		p.Args = []string{`snapshot("a"; inc)`}
+		fsys = testRun(t, "1 2", "1 2", &p)
+		assertEqual(t, string(must(fs.ReadFile(fsys, "a"))), "3")
+		p.Args = []string{`inc`}
+		testRun(t, "1 2", "2 3", &p)
+		p.Args = []string{"-e", `inc`}
+		testRun(t, "1 2", "2 3", &p)
+		p.Args = []string{`|`}
+		testRun(t, "1 2", "error", &p)
+
+		assertEqual(t, len(cache.queries), 3)
+		assertEqual(t, len(cache.defs), 1)
+	}
+
+	p.Args = []string{`snapshot("a"; inc)`}
+	fsys = testRun(t, "5", "5", &p)
+	assertEqual(t, string(must(fs.ReadFile(fsys, "a"))), "6")
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Go(func() {
+			p := p
+			if i%2 == 0 {
+				p.Args = []string{"inc"}
+			}
+			testRun(t, "7", map[bool]string{true: "8", false: "7"}[i%2 == 0], &p)
+		})
+	}
+	wg.Wait()
+}
+func TestCacheEviction(t *testing.T) {
+	cache := &Cache{}
+	for i := range maxQueries * 2 {
+		p := Program{Cache: cache, Args: []string{fmt.Sprint(i)}}
+		testRun(t, "null", fmt.Sprint(i), &p)
+		assertEqual(t, len(cache.queries) <= maxQueries, true)
+	}
+}
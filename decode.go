@@ -0,0 +1,334 @@
+package jqx
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"io"
+	"iter"
+	"maps"
+	"math"
+	"math/big"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// posReader remembers where lines start in the bytes read through it,
+// so that offsets reported by json.Decoder can be given as line numbers.
+type posReader struct {
+	r io.Reader
+	n int64
+
+	newlines    []int64
+	lines       int
+	lastNewline int64
+}
+
+func newPosReader(r io.Reader) *posReader {
+	return &posReader{r: r, lastNewline: -1}
+}
+
+func (p *posReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	for i, c := range b[:n] {
+		if c == '\n' {
+			p.newlines = append(p.newlines, p.n+int64(i))
+		}
+	}
+	p.n += int64(n)
+	return n, err
+}
+
+// position returns the 1-based line and column of offset.
+// Offsets passed in must never decrease, as earlier lines are forgotten.
+func (p *posReader) position(offset int64) (line, col int) {
+	i, _ := slices.BinarySearch(p.newlines, offset)
+	if i > 0 {
+		p.lines += i
+		p.lastNewline = p.newlines[i-1]
+		p.newlines = p.newlines[i:]
+	}
+	return p.lines + 1, int(offset - p.lastNewline)
+}
+
+// decoder yields the JSON values in r, with numbers as gojq represents them.
+// Malformed values abort decoding, unless skip is non-nil,
+// in which case skip is called and decoding resumes on the next line.
+// If keys is non-nil, the order of object keys is recorded in it.
+func decoder(r io.Reader, name string, skip func(error), keys *keyOrder) iter.Seq[any] {
+	return func(yield func(any) bool) {
+		pr := newPosReader(r)
+		base := int64(0)
+		decoder := json.NewDecoder(pr)
+		decoder.UseNumber()
+		for {
+			var v any
+			var err error
+			if keys == nil {
+				err = decoder.Decode(&v)
+			} else {
+				var raw json.RawMessage
+				err = decoder.Decode(&raw)
+				if err == nil {
+					d := json.NewDecoder(bytes.NewReader(raw))
+					d.UseNumber()
+					err = d.Decode(&v)
+					keys.scan(json.NewDecoder(bytes.NewReader(raw)), v, "")
+				}
+			}
+			if err == io.EOF {
+				return
+			}
+
+			var syntaxErr *json.SyntaxError
+			switch {
+			case err == nil:
+				pr.position(base + decoder.InputOffset())
+				if !yield(normalizeNumbers(v)) {
+					return
+				}
+				continue
+			case errors.As(err, &syntaxErr):
+			case errors.Is(err, io.ErrUnexpectedEOF):
+			default:
+				failif(err, "reading %s", name)
+			}
+
+			offset := pr.n
+			if syntaxErr != nil {
+				offset = base + syntaxErr.Offset - 1
+			}
+			line, col := pr.position(offset)
+			err = &DecodeError{name, offset, line, col, err}
+			err = failError{"error while decoding " + err.Error(), exitSystem, err}
+			if skip == nil {
+				panic(err)
+			}
+			skip(err)
+			if syntaxErr == nil {
+				return
+			}
+
+			// Resume after the line containing the error
+			pos := base + decoder.InputOffset()
+			rest := bufio.NewReader(io.MultiReader(decoder.Buffered(), pr))
+			n, _ := io.CopyN(io.Discard, rest, offset-pos)
+			skipped, _ := rest.ReadBytes('\n')
+			base = pos + n + int64(len(skipped))
+
+			buffered, _ := rest.Peek(rest.Buffered())
+			decoder = json.NewDecoder(io.MultiReader(bytes.NewReader(buffered), pr))
+			decoder.UseNumber()
+		}
+	}
+}
+
+// normalizeNumbers replaces the json.Numbers in v with the kinds gojq uses:
+// int, *big.Int for integers too large for it, and float64.
+// As in jq, floats too large for float64 are clamped.
+func normalizeNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil && math.MinInt <= i && i <= math.MaxInt {
+			return int(i)
+		}
+		if !strings.ContainsAny(v.String(), ".eE") {
+			if i, ok := new(big.Int).SetString(v.String(), 10); ok {
+				return i
+			}
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return math.Copysign(math.MaxFloat64, f)
+		}
+		return f
+	case map[string]any:
+		for k, e := range v {
+			v[k] = normalizeNumbers(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = normalizeNumbers(e)
+		}
+	}
+	return v
+}
+
+// keyOrder remembers the order that object keys were read in,
+// so that objects can be written with their keys in their original order.
+// Objects that were read keep their own order. Objects that a query builds or changes
+// take the order of the keys read at the path that shares the most keys with them,
+// and keys never read come last, sorted as usual.
+type keyOrder struct {
+	mu      sync.Mutex
+	objects map[unsafe.Pointer]map[string]int
+
+	// paths holds the keys read at each path, with array indices left out, in the order first read
+	paths []pathKeys
+	index map[string]int
+	byKey map[string][]int
+}
+
+type pathKeys struct {
+	path string
+	rank map[string]int
+}
+
+func objectID(obj map[string]any) unsafe.Pointer {
+	return reflect.ValueOf(obj).UnsafePointer()
+}
+
+// add records the order of the keys of obj, which was read at path.
+// obj is nil when only the path is known, such as when merging.
+func (k *keyOrder) add(obj map[string]any, keys []string, path string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.objects == nil {
+		k.objects = map[unsafe.Pointer]map[string]int{}
+		k.index = map[string]int{}
+		k.byKey = map[string][]int{}
+	}
+
+	rank := map[string]int{}
+	for _, key := range keys {
+		if _, ok := rank[key]; !ok {
+			rank[key] = len(rank)
+		}
+	}
+	if obj != nil {
+		k.objects[objectID(obj)] = rank
+	}
+
+	i, ok := k.index[path]
+	if !ok {
+		i = len(k.paths)
+		k.index[path] = i
+		k.paths = append(k.paths, pathKeys{path, map[string]int{}})
+	}
+	pathRank := k.paths[i].rank
+	for _, key := range keys {
+		if _, ok := pathRank[key]; !ok {
+			pathRank[key] = len(pathRank)
+			k.byKey[key] = append(k.byKey[key], i)
+		}
+	}
+}
+
+// merge adds the orders recorded by other, after those already recorded.
+func (k *keyOrder) merge(other *keyOrder) {
+	other.mu.Lock()
+	objects := maps.Clone(other.objects)
+	var paths []pathKeys
+	for _, p := range other.paths {
+		paths = append(paths, pathKeys{p.path, maps.Clone(p.rank)})
+	}
+	other.mu.Unlock()
+
+	for _, p := range paths {
+		keys := slices.SortedFunc(maps.Keys(p.rank), func(a, b string) int { return cmp.Compare(p.rank[a], p.rank[b]) })
+		k.add(nil, keys, p.path)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	maps.Copy(k.objects, objects)
+}
+
+// forget drops the orders of the objects in v, once nothing more is written from them,
+// so that they are not kept alive for as long as k is.
+func (k *keyOrder) forget(v any) {
+	if k == nil {
+		return
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		k.mu.Lock()
+		delete(k.objects, objectID(v))
+		k.mu.Unlock()
+		for _, e := range v {
+			k.forget(e)
+		}
+	case []any:
+		for _, e := range v {
+			k.forget(e)
+		}
+	}
+}
+
+// scan records the key order of each object in the JSON read by dec, which decodes to v.
+func (k *keyOrder) scan(dec *json.Decoder, v any, path string) {
+	tok, err := dec.Token()
+	if err != nil {
+		return
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj, _ := v.(map[string]any)
+		k.add(nil, nil, path) // paths are ranked by where they start
+		var keys []string
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return
+			}
+			key, _ := tok.(string)
+			keys = append(keys, key)
+			k.scan(dec, obj[key], path+"."+strconv.Quote(key))
+		}
+		dec.Token()
+		k.add(obj, keys, path)
+	case json.Delim('['):
+		arr, _ := v.([]any)
+		for i := 0; dec.More(); i++ {
+			var e any
+			if i < len(arr) {
+				e = arr[i]
+			}
+			k.scan(dec, e, path+"[]")
+		}
+		dec.Token()
+	}
+}
+
+// sorted returns the keys of obj in the order they were read.
+func (k *keyOrder) sorted(obj map[string]any) []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	rank, ok := k.objects[objectID(obj)]
+	if !ok {
+		// Fall back to the earliest path sharing the most keys
+		counts := map[int]int{}
+		best := -1
+		for key := range obj {
+			for _, i := range k.byKey[key] {
+				counts[i]++
+				if best < 0 || counts[i] > counts[best] || counts[i] == counts[best] && i < best {
+					best = i
+				}
+			}
+		}
+		if best >= 0 {
+			rank = k.paths[best].rank
+		}
+	}
+
+	return slices.SortedFunc(maps.Keys(obj), func(a, b string) int {
+		ra, okA := rank[a]
+		rb, okB := rank[b]
+		switch {
+		case okA && okB:
+			return cmp.Compare(ra, rb)
+		case okA:
+			return -1
+		case okB:
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+}
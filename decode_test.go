@@ -0,0 +1,105 @@
+package jqx
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPosition(t *testing.T) {
+	const s = "ab\n\ncde\nf"
+	pr := newPosReader(strings.NewReader(s))
+	must(pr.Read(make([]byte, len(s))))
+
+	var got []string
+	for i := range len(s) {
+		line, col := pr.position(int64(i))
+		got = append(got, fmt.Sprint(line, ":", col))
+	}
+	assertString(t, got, `[1:1 1:2 1:3 2:1 3:1 3:2 3:3 3:4 4:1]`)
+}
+
+func TestDecoderSkip(t *testing.T) {
+	decode := func(s string) string {
+		var errs []string
+		skip := func(err error) { errs = append(errs, err.Error()) }
+		got := slices.Collect(decoder(strings.NewReader(s), "in", skip, nil))
+		return fmt.Sprint(got, errs)
+	}
+
+	assertEqual(t, decode("1 2 3"), `[1 2 3] []`)
+	assertEqual(t, decode("1\n[}\n3"), `[1 3] [error while decoding in:2:2: invalid character '}' looking for beginning of value]`)
+	assertEqual(t, decode("1\n[} 2\n3\n"), `[1 3] [error while decoding in:2:2: invalid character '}' looking for beginning of value]`)
+	assertEqual(t, decode("x\ny\n{}"), `[map[]] [error while decoding in:1:1: invalid character 'x' looking for beginning of value error while decoding in:2:1: invalid character 'y' looking for beginning of value]`)
+	assertEqual(t, decode("1 ]\n[1,"), `[1] [error while decoding in:1:3: invalid character ']' looking for beginning of value error while decoding in:2:4: unexpected EOF]`)
+
+	var err error
+	func() {
+		defer catch[failError](&err)
+		for range decoder(strings.NewReader("1\n[}\n3"), "in", nil, nil) {
+		}
+	}()
+	assertString(t, err, `error while decoding in:2:2: invalid character '}' looking for beginning of value`)
+}
+
+func TestDecoderNumbers(t *testing.T) {
+	const s = `1 -2 1.5 1e2 12345678901234567890123 -1e1000 [3, {"a": 4}]`
+	var got []string
+	for v := range decoder(strings.NewReader(s), "in", nil, nil) {
+		got = append(got, fmt.Sprintf("%T:%v", v, v))
+	}
+	assertString(t, got, `[int:1 int:-2 float64:1.5 float64:100 *big.Int:12345678901234567890123 float64:-1.7976931348623157e+308 []interface {}:[3 map[a:4]]]`)
+
+	query := must((&State{}).Compile(`., . + 1, . * 10`))
+	got = nil
+	for v := range decoder(strings.NewReader(`12345678901234567890`), "in", nil, nil) {
+		for v := range query(v) {
+			got = append(got, string(must(format{}.marshal(v))))
+		}
+	}
+	assertString(t, got, `[12345678901234567890 12345678901234567891 123456789012345678900]`)
+}
+
+func TestKeyOrder(t *testing.T) {
+	var keys keyOrder
+	const in = `{"b": {"z\"": "a", "y" :[{"x":1, "b": ":"}]}, "a": "c", "dup": {"q": 1}, "dup": {"p": 2, "o": 3}}`
+	doc := slices.Collect(decoder(strings.NewReader(in), "in", nil, &keys))[0].(map[string]any)
+	assertString(t, keys.sorted(doc), `[b a dup]`)
+	assertString(t, keys.sorted(doc["b"].(map[string]any)), `[z" y]`)
+	assertString(t, keys.sorted(doc["b"].(map[string]any)["y"].([]any)[0].(map[string]any)), `[x b]`)
+	assertString(t, keys.sorted(doc["dup"].(map[string]any)), `[p o]`)
+
+	// Objects that were not read take the order of the path sharing the most keys
+	obj := func(keys ...string) map[string]any {
+		rt := map[string]any{}
+		for _, k := range keys {
+			rt[k] = nil
+		}
+		return rt
+	}
+	assertString(t, keys.sorted(obj("q", "a", "p", "x", "b")), `[b a p q x]`)
+	assertString(t, keys.sorted(obj("q", "x", "b")), `[x b q]`)
+	assertString(t, keys.sorted(obj("n", "m")), `[m n]`)
+
+	var merged keyOrder
+	merged.merge(&keys)
+	assertString(t, merged.sorted(doc["b"].(map[string]any)), `[z" y]`)
+	assertString(t, merged.sorted(obj("q", "x", "b")), `[x b q]`)
+
+	// Inputs are forgotten once written, so that a stream is not kept in memory
+	var stream keyOrder
+	for v := range decoder(strings.NewReader(strings.Repeat(`{"a": {"c": 1, "b": [{"e": 2, "d": 3}]}} `, 100)), "in", nil, &stream) {
+		assertString(t, stream.sorted(v.(map[string]any)["a"].(map[string]any)), `[c b]`)
+		stream.forget(v)
+		assertEqual(t, len(stream.objects), 0)
+	}
+	assertEqual(t, len(stream.paths), 3)
+
+	const s = `{"name": "x", "version": "1.0", "deps": {"z": 1, "a": 2}}`
+	f := format{order: &keyOrder{}}
+	v := slices.Collect(decoder(strings.NewReader(s), "in", nil, f.order))
+	assertEqual(t, string(must(f.marshal(v[0]))), `{"name":"x","version":"1.0","deps":{"z":1,"a":2}}`)
+	f.indent = "\t"
+	assertEqual(t, string(must(f.marshal(v[0]))), "{\n\t\"name\": \"x\",\n\t\"version\": \"1.0\",\n\t\"deps\": {\n\t\t\"z\": 1,\n\t\t\"a\": 2\n\t}\n}")
+}
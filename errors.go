@@ -0,0 +1,83 @@
+package jqx
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/itchyny/gojq"
+)
+
+// QueryParseError is returned when a query cannot be parsed or compiled.
+type QueryParseError struct {
+	Query string
+	// Offset is the byte offset in Query where the error was found, or -1 if unknown.
+	Offset int
+	Err    error
+}
+
+func (e *QueryParseError) Error() string {
+	if e.Offset < 0 {
+		return e.Err.Error()
+	}
+	return e.Err.Error() + "\n" + pointAt(e.Query, e.Offset)
+}
+func (e *QueryParseError) Unwrap() error { return e.Err }
+
+// DecodeError is returned when an input is not valid JSON.
+type DecodeError struct {
+	File   string
+	Offset int64
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %v", e.File, e.Line, e.Column, e.Err)
+}
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// RuntimeError is yielded when a query fails while running.
+type RuntimeError struct {
+	// Value is the error value, as it would be caught by try.
+	Value any
+	Err   error
+}
+
+func (e *RuntimeError) Error() string { return e.Err.Error() }
+func (e *RuntimeError) Unwrap() error { return e.Err }
+
+// LimitError is returned when a query or its input exceeds one of its [Limits].
+type LimitError struct {
+	Limit string
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("exceeded limit of %d %s", e.Max, e.Limit)
+}
+
+func newRuntimeError(err error) *RuntimeError {
+	var value any = err.Error()
+	if err, ok := err.(gojq.ValueError); ok {
+		value = err.Value()
+	}
+	return &RuntimeError{value, err}
+}
+
+func newQueryParseError(query string, err error) *QueryParseError {
+	offset := -1
+	var parseErr *gojq.ParseError
+	if errors.As(err, &parseErr) {
+		offset = parseErr.Offset - len(parseErr.Token)
+	} else if m := undefinedRe.FindStringSubmatch(err.Error()); m != nil {
+		re := regexp.MustCompile(`(?:^|[^\w$])(` + regexp.QuoteMeta(m[1]) + `)\b`)
+		if loc := re.FindStringSubmatchIndex(query); loc != nil {
+			offset = loc[2]
+		}
+	}
+	return &QueryParseError{query, offset, err}
+}
+
+var undefinedRe = regexp.MustCompile(`^(?:function|variable) not defined: (\$?[\w:]+)`)
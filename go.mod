@@ -6,6 +6,7 @@ require (
 	github.com/alecthomas/chroma/v2 v2.15.0
 	github.com/andybalholm/cascadia v1.3.3
 	github.com/antchfx/xmlquery v1.5.0
+	github.com/atotto/clipboard v0.1.4
 	github.com/charmbracelet/bubbles v0.20.0
 	github.com/charmbracelet/bubbletea v1.3.3
 	github.com/charmbracelet/lipgloss v1.0.0
@@ -15,7 +16,6 @@ require (
 
 require (
 	github.com/antchfx/xpath v1.3.5 // indirect
-	github.com/atotto/clipboard v0.1.4 // indirect
 	github.com/aymanbagabas/go-osc52/v2 v2.0.1 // indirect
 	github.com/charmbracelet/x/ansi v0.8.0 // indirect
 	github.com/charmbracelet/x/term v0.2.1 // indirect
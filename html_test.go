@@ -30,9 +30,9 @@ func TestHTMLQuerySelector(t *testing.T) {
 		</html>
 	`
 
-	query := (&State{
+	query := must((&State{
 		Globals: map[string]any{"html": html},
-	}).Compile(`. as $sel | $html | [htmlq($sel)] | join("  ;  ")`)
+	}).Compile(`. as $sel | $html | [htmlq($sel)] | join("  ;  ")`))
 
 	assert := func(selector, want string) {
 		t.Helper()
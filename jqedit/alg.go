@@ -5,6 +5,8 @@ import (
 	"sync/atomic"
 	"unicode"
 	"unicode/utf8"
+
+	"github.com/charmbracelet/lipgloss"
 )
 
 // watcher creates a pair of functions to set and wait for a value to change.
@@ -46,8 +48,15 @@ func watcher[T comparable]() (set func(T), wait func(*T)) {
 }
 
 func truncLines(text string, width int) string {
-	const ellipses = "..................."
+	lines := strings.Split(cleanText(text), "\n")
+	for i, line := range lines {
+		lines[i] = cropLine(line, 0, width)
+	}
+	return strings.Join(lines, "\n")
+}
 
+// cleanText replaces characters that would upset the layout of the terminal.
+func cleanText(text string) string {
 	text = strings.Map(func(r rune) rune {
 		if !unicode.IsPrint(r) {
 			switch r {
@@ -61,15 +70,122 @@ func truncLines(text string, width int) string {
 		}
 		return r
 	}, text)
-	text = strings.ReplaceAll(text, "\t", "        ")
-	lines := strings.Split(text, "\n")
-	for line := range lines {
-		line := &lines[line]
-		if len(*line) > width {
-			n := max(width-3, 0)
-			*line = (*line)[:n] + ellipses[:width-n]
+	return strings.ReplaceAll(text, "\t", "        ")
+}
+
+// cropLine returns the width runes of line starting at offset,
+// ending with dots if the line goes on past them.
+func cropLine(line string, offset, width int) string {
+	const ellipses = "..................."
+
+	runes := []rune(line)
+	runes = runes[min(offset, len(runes)):]
+	if len(runes) > width {
+		n := max(width-3, 0)
+		return string(runes[:n]) + ellipses[:width-n]
+	}
+	return string(runes)
+}
+
+// wrapLine splits line into rows of width runes.
+func wrapLine(line string, width int) []string {
+	runes := []rune(line)
+	rows := []string{}
+	for len(runes) > width && width > 0 {
+		rows = append(rows, string(runes[:width]))
+		runes = runes[width:]
+	}
+	return append(rows, string(runes))
+}
+
+// match is an occurrence of a search, in runes.
+type match struct {
+	line, col, len int
+}
+
+// findMatches finds pattern in lines, ignoring case.
+func findMatches(lines []string, pattern string) []match {
+	if pattern == "" {
+		return nil
+	}
+	pattern = strings.ToLower(pattern)
+	n := utf8.RuneCountInString(pattern)
+
+	var rt []match
+	for i, line := range lines {
+		runes := []rune(strings.ToLower(line))
+		if len(runes) != utf8.RuneCountInString(line) {
+			continue
+		}
+		lower := string(runes)
+		for at := 0; ; {
+			j := strings.Index(lower[at:], pattern)
+			if j < 0 {
+				break
+			}
+			col := utf8.RuneCountInString(lower[:at+j])
+			rt = append(rt, match{i, col, n})
+			at += j + len(pattern)
+		}
+	}
+	return rt
+}
+
+// layout says how lines are fit into the width of the viewport:
+// by wrapping them, or by cropping them after scrolling right by offset.
+type layout struct {
+	width  int
+	wrap   bool
+	offset int
+}
+
+// renderLines lays out lines, marking matches with matchStyle and the current one with currentStyle.
+// It returns the rows to show and the row of the current match.
+func renderLines(lines []string, matches []match, current int, l layout, matchStyle, currentStyle lipgloss.Style) (rows []string, currentRow int) {
+	byLine := map[int][]int{}
+	for i, m := range matches {
+		byLine[m.line] = append(byLine[m.line], i)
+	}
+
+	for i, line := range lines {
+		// styles holds the style of each rune in line
+		var styles []*lipgloss.Style
+		for _, k := range byLine[i] {
+			if styles == nil {
+				styles = make([]*lipgloss.Style, utf8.RuneCountInString(line))
+			}
+			m := matches[k]
+			style := &matchStyle
+			if k == current {
+				style = &currentStyle
+				currentRow = len(rows)
+				if l.wrap && l.width > 0 {
+					currentRow += m.col / l.width
+				}
+			}
+			for j := m.col; j < min(m.col+m.len, len(styles)); j++ {
+				styles[j] = style
+			}
+		}
+
+		segments := []string{cropLine(line, l.offset, l.width)}
+		start := l.offset
+		if l.wrap {
+			segments = wrapLine(line, l.width)
+			start = 0
+		}
+		for _, seg := range segments {
+			var row strings.Builder
+			for j, r := range []rune(seg) {
+				if start+j < len(styles) && styles[start+j] != nil {
+					row.WriteString(styles[start+j].Render(string(r)))
+				} else {
+					row.WriteRune(r)
+				}
+			}
+			rows = append(rows, row.String())
+			start += utf8.RuneCountInString(seg)
 		}
 	}
-	text = strings.Join(lines, "\n")
-	return text
+	return
 }
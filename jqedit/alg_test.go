@@ -1,8 +1,12 @@
 package main
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 	"testing/synctest"
+
+	"github.com/charmbracelet/lipgloss"
 )
 
 func assertEqual[T comparable](tb testing.TB, got T, want T) {
@@ -73,3 +77,42 @@ func TestTruncLines(t *testing.T) {
 		}
 	})
 }
+
+func TestCropLine(t *testing.T) {
+	assertEqual(t, cropLine("abcdefg", 0, 20), "abcdefg")
+	assertEqual(t, cropLine("abcdefg", 2, 20), "cdefg")
+	assertEqual(t, cropLine("abcdefg", 2, 4), "c...")
+	assertEqual(t, cropLine("abcdefg", 10, 4), "")
+	assertEqual(t, cropLine("ééééé", 1, 3), "...")
+	assertEqual(t, cropLine("ééééé", 1, 4), "éééé")
+}
+
+func TestWrapLine(t *testing.T) {
+	assertEqual(t, strings.Join(wrapLine("abcdefg", 3), "/"), "abc/def/g")
+	assertEqual(t, strings.Join(wrapLine("abcdef", 3), "/"), "abc/def")
+	assertEqual(t, strings.Join(wrapLine("", 3), "/"), "")
+	assertEqual(t, strings.Join(wrapLine("éééé", 2), "/"), "éé/éé")
+}
+
+func TestFindMatches(t *testing.T) {
+	lines := []string{"Abc abc", "xyz", "éabc"}
+	assertEqual(t, fmt.Sprint(findMatches(lines, "ABC")), "[{0 0 3} {0 4 3} {2 1 3}]")
+	assertEqual(t, fmt.Sprint(findMatches(lines, "")), "[]")
+	assertEqual(t, fmt.Sprint(findMatches([]string{"aaaa"}, "aa")), "[{0 0 2} {0 2 2}]")
+}
+
+func TestRenderLines(t *testing.T) {
+	lines := []string{"0123456789", "ab", "0123456789"}
+	matches := findMatches(lines, "78")
+	mark := lipgloss.NewStyle().Transform(strings.ToUpper)
+	current := lipgloss.NewStyle().Transform(func(s string) string { return "<" + s + ">" })
+	render := func(current_ int, l layout) string {
+		rows, row := renderLines(lines, matches, current_, l, mark, current)
+		return fmt.Sprint(strings.Join(rows, "/"), " ", row)
+	}
+
+	assertEqual(t, render(0, layout{width: 20}), "0123456<7><8>9/ab/0123456789 0")
+	assertEqual(t, render(1, layout{width: 5}), "01.../ab/01... 2")
+	assertEqual(t, render(1, layout{width: 5, offset: 6}), "6789//6<7><8>9 2")
+	assertEqual(t, render(1, layout{width: 4, wrap: true}), "0123/4567/89/ab/0123/456<7>/<8>9 5")
+}
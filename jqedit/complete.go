@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+type completionKind int
+
+const (
+	completeFunc completionKind = iota
+	completeKey
+	completeVar
+)
+
+func isIdentByte(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// completionContext works out what is being typed at the end of before,
+// which is the query up to the cursor. word is the part typed so far.
+// For keys, base is a query whose outputs are the objects being indexed.
+// ok is false inside strings and comments, where nothing is completed.
+func completionContext(before string) (kind completionKind, word, base string, ok bool) {
+	lastLine := before[strings.LastIndexByte(before, '\n')+1:]
+	if inString(before) || strings.Contains(stripStrings(lastLine), "#") {
+		return 0, "", "", false
+	}
+
+	i := len(before)
+	for i > 0 && isIdentByte(before[i-1]) {
+		i--
+	}
+	word = before[i:]
+
+	switch {
+	case i > 0 && before[i-1] == '$':
+		return completeVar, word, "", true
+	case i > 0 && before[i-1] == '.':
+		return completeKey, word, keyBase(before[:i-1]), true
+	}
+	return completeFunc, word, "", true
+}
+
+// keyBase returns a query for the input of a path that follows prefix.
+func keyBase(prefix string) string {
+	prefix = strings.TrimRight(prefix, " \t\n")
+	if prefix == "" {
+		return "."
+	}
+
+	switch c := prefix[len(prefix)-1]; {
+	case c == '|':
+		return keyBase(prefix[:len(prefix)-1])
+	case isIdentByte(c) || strings.IndexByte(`.])"?`, c) >= 0:
+		// prefix is a path, such as .a[0]
+		return prefix
+	}
+
+	// Within other expressions, fall back to the input of the pipe
+	if i := strings.LastIndexByte(prefix, '|'); i >= 0 {
+		return keyBase(prefix[:i])
+	}
+	return "."
+}
+
+func inString(s string) bool {
+	in := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case in && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			in = !in
+		}
+	}
+	return in
+}
+
+var stringRe = regexp.MustCompile(`"(\\.|[^"\\])*"`)
+
+func stripStrings(s string) string {
+	return stringRe.ReplaceAllString(s, `""`)
+}
+
+var (
+	varRe = regexp.MustCompile(`\$[a-zA-Z_][a-zA-Z0-9_]*`)
+	defRe = regexp.MustCompile(`\bdef\s+([a-zA-Z_][a-zA-Z0-9_]*)`)
+)
+
+// queryNames returns the variables and functions named in code,
+// such as those it binds with as and def.
+func queryNames(code string) (vars, funcs []string) {
+	for _, v := range varRe.FindAllString(code, -1) {
+		vars = append(vars, v[1:])
+	}
+	for _, m := range defRe.FindAllStringSubmatch(code, -1) {
+		funcs = append(funcs, m[1])
+	}
+	return
+}
+
+// filterCompletions returns the distinct candidates that start with word, other than word itself.
+// Names starting with _ are internal, so they are left out unless word starts with _ too.
+func filterCompletions(candidates []string, word string) []string {
+	var rt []string
+	for _, c := range candidates {
+		if c == word || !strings.HasPrefix(c, word) {
+			continue
+		}
+		if strings.HasPrefix(c, "_") && !strings.HasPrefix(word, "_") {
+			continue
+		}
+		rt = append(rt, c)
+	}
+	slices.Sort(rt)
+	return slices.Compact(rt)
+}
+
+// completionText returns the text that replaces word when c is chosen.
+func completionText(kind completionKind, c string) string {
+	if kind == completeKey && !identRe.MatchString(c) {
+		return string(must(json.Marshal(c)))
+	}
+	return c
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestCompletionContext(t *testing.T) {
+	ctx := func(before string) string {
+		kind, word, base, ok := completionContext(before)
+		if !ok {
+			return "none"
+		}
+		return fmt.Sprintf("%d %q %q", kind, word, base)
+	}
+
+	assertEqual(t, ctx(""), `0 "" ""`)
+	assertEqual(t, ctx("map(sel"), `0 "sel" ""`)
+	assertEqual(t, ctx("."), `1 "" "."`)
+	assertEqual(t, ctx(".g.h"), `1 "h" ".g"`)
+	assertEqual(t, ctx(".d[0].x"), `1 "x" ".d[0]"`)
+	assertEqual(t, ctx(".g | .h"), `1 "h" ".g"`)
+	assertEqual(t, ctx(".g |\n  ."), `1 "" ".g"`)
+	assertEqual(t, ctx(".g | [.a, ."), `1 "" ".g"`)
+	assertEqual(t, ctx("{a: ."), `1 "" "."`)
+	assertEqual(t, ctx(". as $x | $"), `2 "" ""`)
+	assertEqual(t, ctx("$fi"), `2 "fi" ""`)
+	assertEqual(t, ctx(`"a.b`), "none")
+	assertEqual(t, ctx(`"a\".b" | .`), `1 "" "\"a\\\".b\""`)
+	assertEqual(t, ctx(". # .a"), "none")
+	assertEqual(t, ctx(`"#" | .a`), `1 "a" "\"#\""`)
+}
+
+func TestFilterCompletions(t *testing.T) {
+	candidates := []string{"map", "max", "map_values", "_internal", "map", "min"}
+	assertEqual(t, fmt.Sprint(filterCompletions(candidates, "ma")), "[map map_values max]")
+	assertEqual(t, fmt.Sprint(filterCompletions(candidates, "map")), "[map_values]")
+	assertEqual(t, fmt.Sprint(filterCompletions(candidates, "")), "[map map_values max min]")
+	assertEqual(t, fmt.Sprint(filterCompletions(candidates, "_")), "[_internal]")
+
+	assertEqual(t, completionText(completeKey, "abc"), "abc")
+	assertEqual(t, completionText(completeKey, "a b"), `"a b"`)
+	assertEqual(t, completionText(completeFunc, "abc"), "abc")
+}
+
+func TestQueryNames(t *testing.T) {
+	vars, funcs := queryNames(`def f($a): $a; def g: 1; . as $xy | f($xy)`)
+	assertEqual(t, fmt.Sprint(vars), "[a a xy xy]")
+	assertEqual(t, fmt.Sprint(funcs), "[f g]")
+}
+
+func TestCandidates(t *testing.T) {
+	d := data{code: `. as $mine | .`}
+	has := func(kind completionKind, base string, want ...string) {
+		t.Helper()
+		got := d.candidates(context.Background(), kind, base)
+		for _, want := range want {
+			if !slices.Contains(got, want) {
+				t.Error(want, "not in", got)
+			}
+		}
+	}
+
+	has(completeKey, ".", "a", "b", "d", "g", "l")
+	has(completeKey, ".g", "h", "j")
+	has(completeVar, "", "files", "vars", "ENV", "mine")
+	// jqx does not support $__loc__
+	assertEqual(t, slices.Contains(d.candidates(context.Background(), completeVar, ""), "__loc__"), false)
+	has(completeFunc, "", "map", "htmlq", "snapshot", "fields", "listregex")
+	assertEqual(t, len(d.candidates(context.Background(), completeKey, ".d")), 0)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2/quick"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// maxHighlight bounds the output that is highlighted, as lexing is slow on large outputs.
+const maxHighlight = 1 << 20
+
+var xmlRe = regexp.MustCompile(`^<(\?xml|[a-zA-Z][\w:.-]*[\s>/])`)
+
+// outputLexer chooses a chroma lexer for text by how it starts, or returns "" for plain text.
+func outputLexer(text string) string {
+	text = strings.TrimSpace(text)
+	switch {
+	case text == "":
+	case strings.IndexByte(`{["`, text[0]) >= 0:
+		return "json"
+	case strings.HasPrefix(text, "<?xml"):
+		return "xml"
+	case strings.HasPrefix(strings.ToLower(text), "<!doctype html"), strings.HasPrefix(strings.ToLower(text), "<html"):
+		return "html"
+	case xmlRe.MatchString(text):
+		return "html"
+	}
+	return ""
+}
+
+// highlightOutput colors text for the terminal, if it looks like JSON, HTML or XML.
+func highlightOutput(text string) string {
+	lexer := outputLexer(text)
+	if lexer == "" || len(text) > maxHighlight {
+		return text
+	}
+	var rt strings.Builder
+	if quick.Highlight(&rt, text, lexer, "terminal256", "github") != nil {
+		return text
+	}
+	return rt.String()
+}
+
+type tokenKind int
+
+const (
+	tokPlain tokenKind = iota
+	tokString
+	tokComment
+	tokNumber
+	tokKeyword
+	tokVariable
+	tokField
+	tokFunc
+	tokOperator
+)
+
+var (
+	queryTokenRe = regexp.MustCompile(`^(?:` +
+		`(?P<comment>#[^\n]*)|` +
+		`(?P<string>"(?:\\.|[^"\\])*"?)|` +
+		`(?P<number>\d+(?:\.\d*)?(?:[eE][+-]?\d+)?)|` +
+		`(?P<variable>\$(?:__loc__|[a-zA-Z_][a-zA-Z0-9_]*(?:::[a-zA-Z_][a-zA-Z0-9_]*)*))|` +
+		`(?P<field>\.[a-zA-Z_][a-zA-Z0-9_]*)|` +
+		`(?P<ident>[a-zA-Z_][a-zA-Z0-9_]*(?:::[a-zA-Z_][a-zA-Z0-9_]*)*)|` +
+		`(?P<operator>\?//|//=?|[|=!<>]=|[-+*/%]=|\|=|[-+*/%<>=|,:;?]|\.\.?)` +
+		`)`)
+	tokenGroups = map[string]tokenKind{
+		"comment":  tokComment,
+		"string":   tokString,
+		"number":   tokNumber,
+		"variable": tokVariable,
+		"field":    tokField,
+		"ident":    tokFunc,
+		"operator": tokOperator,
+	}
+	keywords = strings.Fields(`def as if then elif else end reduce foreach try catch label import include and or not __loc__`)
+)
+
+// lexQuery returns the kind of each byte of code.
+func lexQuery(code string) []tokenKind {
+	rt := make([]tokenKind, len(code))
+	for i := 0; i < len(code); {
+		m := queryTokenRe.FindStringSubmatchIndex(code[i:])
+		if m == nil {
+			i++
+			continue
+		}
+
+		kind := tokPlain
+		for group, name := range queryTokenRe.SubexpNames() {
+			if name == "" || m[2*group] < 0 {
+				continue
+			}
+			kind = tokenGroups[name]
+			if kind == tokFunc && slices.Contains(keywords, code[i:i+m[1]]) {
+				kind = tokKeyword
+			}
+		}
+		for j := range m[1] {
+			rt[i+j] = kind
+		}
+		i += m[1]
+	}
+	return rt
+}
+
+// matchBracket finds the bracket at or just before cursor and the one matching it,
+// ignoring brackets in strings and comments.
+func matchBracket(code string, kinds []tokenKind, cursor int) (a, b int, ok bool) {
+	const open, close = "([{", ")]}"
+
+	var stack []int
+	pairs := map[int]int{}
+	for i := range len(code) {
+		if kinds[i] == tokString || kinds[i] == tokComment {
+			continue
+		}
+		if strings.IndexByte(open, code[i]) >= 0 {
+			stack = append(stack, i)
+		} else if j := strings.IndexByte(close, code[i]); j >= 0 && len(stack) > 0 {
+			top := stack[len(stack)-1]
+			if code[top] == open[j] {
+				stack = stack[:len(stack)-1]
+				pairs[top], pairs[i] = i, top
+			}
+		}
+	}
+
+	for _, a := range []int{cursor, cursor - 1} {
+		if b, ok := pairs[a]; ok {
+			return a, b, true
+		}
+	}
+	return 0, 0, false
+}
+
+var tokenStyles = map[tokenKind]lipgloss.Style{
+	tokString:   lipgloss.NewStyle().Foreground(lipgloss.Color("#0a3069")),
+	tokComment:  commentStyle,
+	tokNumber:   lipgloss.NewStyle().Foreground(lipgloss.Color("#0550ae")),
+	tokKeyword:  lipgloss.NewStyle().Foreground(lipgloss.Color("#cf222e")).Bold(true),
+	tokVariable: lipgloss.NewStyle().Foreground(lipgloss.Color("#953800")),
+	tokField:    lipgloss.NewStyle().Foreground(lipgloss.Color("#116329")),
+	tokFunc:     lipgloss.NewStyle().Foreground(lipgloss.Color("#8250df")),
+	tokOperator: lipgloss.NewStyle().Foreground(lipgloss.Color("#6e7781")),
+}
+
+var (
+	bracketStyle = lipgloss.NewStyle().Bold(true).Underline(true)
+	cursorStyle  = lipgloss.NewStyle().Reverse(true)
+)
+
+// highlightQuery renders code, with the cursor at the byte offset cursor,
+// as rows of at most width runes, and returns the row the cursor is on.
+// Each row is prefixed with gutter(line), where line is -1 for wrapped rows.
+func highlightQuery(code string, cursor, width int, gutter func(line int) string) (rows []string, cursorRow int) {
+	kinds := lexQuery(code)
+	a, b, matched := matchBracket(code, kinds, cursor)
+	width = max(width, 1)
+
+	var row strings.Builder
+	runes := 0
+	line := 0
+	newRow := func(wrapped bool) {
+		rows = append(rows, row.String())
+		row.Reset()
+		runes = 0
+		if wrapped {
+			row.WriteString(gutter(-1))
+		} else {
+			line++
+			row.WriteString(gutter(line))
+		}
+	}
+	row.WriteString(gutter(0))
+
+	for i, r := range code + " " {
+		if runes == width {
+			newRow(true)
+		}
+		if i == cursor {
+			cursorRow = len(rows)
+		}
+
+		s := string(r)
+		if r == '\n' || i == len(code) {
+			s = " "
+		}
+
+		var style lipgloss.Style
+		switch {
+		case i == cursor:
+			style = cursorStyle
+		case matched && (i == a || i == b):
+			style = bracketStyle
+		case i < len(code):
+			style = tokenStyles[kinds[i]]
+		}
+		row.WriteString(style.Render(s))
+		runes++
+
+		if r == '\n' && i < len(code) {
+			newRow(false)
+		}
+	}
+	rows = append(rows, row.String())
+	return
+}
+
+// editorView renders the query like the textarea does, but highlighted.
+func (m model) editorView() string {
+	code := m.textarea.Value()
+	if code == "" {
+		return m.textarea.View()
+	}
+
+	digits := len(fmt.Sprint(m.textarea.MaxHeight))
+	gutter := func(line int) string {
+		number := ""
+		if line >= 0 {
+			number = fmt.Sprint(line + 1)
+		}
+		number = fmt.Sprintf(" %*s ", digits, number)
+		style := m.textarea.FocusedStyle
+		return style.Prompt.Render(m.textarea.Prompt) + style.LineNumber.Render(number)
+	}
+	width := m.textarea.Width()
+
+	rows, cursorRow := highlightQuery(code, len(m.beforeCursor()), width, gutter)
+	height := m.textarea.Height()
+	start := max(cursorRow-height+1, 0)
+	rows = rows[start:min(start+height, len(rows))]
+	for len(rows) < height {
+		rows = append(rows, m.textarea.FocusedStyle.Prompt.Render(m.textarea.Prompt))
+	}
+	return strings.Join(rows, "\n")
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOutputLexer(t *testing.T) {
+	for text, want := range map[string]string{
+		`{"a":1}`:                   "json",
+		"\n [1]":                    "json",
+		`"str"`:                     "json",
+		`plain text`:                "",
+		`5`:                         "",
+		``:                          "",
+		`<?xml version="1.0"?><a/>`: "xml",
+		`<!DOCTYPE html><html>`:     "html",
+		`<div class="x">`:           "html",
+		`<br/>`:                     "html",
+		`< 5`:                       "",
+	} {
+		assertEqual(t, outputLexer(text), want)
+	}
+}
+
+func TestLexQuery(t *testing.T) {
+	const code = `def f: .a | "s#(" as $x # c`
+	kinds := lexQuery(code)
+	var got strings.Builder
+	for _, k := range kinds {
+		got.WriteByte(" sc#kv.fo"[k])
+	}
+	assertEqual(t, got.String(), `kkk fo .. o sssss kk vv ccc`)
+}
+
+func TestMatchBracket(t *testing.T) {
+	const code = `[.a, ("(", {b: 1})]`
+	kinds := lexQuery(code)
+	match := func(cursor int) string {
+		a, b, ok := matchBracket(code, kinds, cursor)
+		if !ok {
+			return "none"
+		}
+		return code[a:a+1] + code[b:b+1]
+	}
+	assertEqual(t, match(0), "[]")
+	assertEqual(t, match(1), "[]")
+	assertEqual(t, match(2), "none")
+	assertEqual(t, match(5), "()")
+	assertEqual(t, match(7), "none")
+	assertEqual(t, match(11), "{}")
+	assertEqual(t, match(len(code)), "][")
+}
+
+func TestHighlightQuery(t *testing.T) {
+	gutter := func(line int) string {
+		if line < 0 {
+			return "  "
+		}
+		return string(rune('1'+line)) + " "
+	}
+	rows, cursorRow := highlightQuery(".abcdef |\nmap(.)", 12, 4, gutter)
+	assertEqual(t, strings.Join(rows, "/"), "1 .abc/  def /  | /2 map(/  .) ")
+	assertEqual(t, cursorRow, 3)
+}
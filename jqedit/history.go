@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxHistory bounds the entries loaded from the history file.
+const maxHistory = 1000
+
+// maxHistorySize is the size past which the history file is trimmed to its latest maxHistory entries.
+const maxHistorySize = 1 << 20
+
+type historyEntry struct {
+	Time  time.Time `json:"time"`
+	Query string    `json:"query"`
+	Input string    `json:"input"`
+
+	// Stages are the stages piped into Query, if it was built in stages
+	Stages []string `json:"stages,omitempty"`
+}
+
+// text is the whole query of e, with its stages, for showing and searching.
+func (e historyEntry) text() string {
+	return strings.Join(append(slices.Clone(e.Stages), e.Query), " | ")
+}
+
+// historyPath is where successful queries are saved, following the XDG state directory.
+func historyPath() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "jqx", "history.jsonl")
+}
+
+// loadHistory reads up to maxHistory of the latest entries, oldest first, skipping malformed lines.
+func loadHistory(r io.Reader) []historyEntry {
+	var rt []historyEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e historyEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil && e.Query != "" {
+			rt = append(rt, e)
+		}
+	}
+	return rt[max(len(rt)-maxHistory, 0):]
+}
+
+// appendHistory adds e to the end of the history file, trimming the file once it grows past maxHistorySize.
+func appendHistory(path string, e historyEntry) error {
+	if path == "" {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	b := append(must(json.Marshal(e)), '\n')
+	_, err = f.Write(b)
+	err = cmp.Or(err, f.Close())
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.Size() <= maxHistorySize {
+		return err
+	}
+	return trimHistory(path)
+}
+
+// trimHistory rewrites the history file with only the entries that loadHistory reads from it.
+// The file is replaced in one step, so that it is never left half written.
+func trimHistory(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	entries := loadHistory(f)
+	f.Close()
+
+	var b []byte
+	for _, e := range entries {
+		b = append(b, must(json.Marshal(e))...)
+		b = append(b, '\n')
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, b, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// history recalls earlier queries with up and down, like a shell.
+type history struct {
+	entries []historyEntry
+
+	// pos is the entry being shown, or len(entries) for the query being written
+	pos   int
+	draft historyEntry
+}
+
+func (h *history) add(e historyEntry) {
+	h.entries = append(h.entries, e)
+	h.pos = len(h.entries)
+}
+
+// prev returns the entry before the one shown, skipping repeats of it.
+// current is kept as a draft, to return to with next.
+func (h *history) prev(current historyEntry) (historyEntry, bool) {
+	if h.pos == len(h.entries) {
+		h.draft = current
+	}
+	for i := h.pos - 1; i >= 0; i-- {
+		if e := h.entries[i]; e.text() != current.text() {
+			h.pos = i
+			return e, true
+		}
+	}
+	return historyEntry{}, false
+}
+
+// next returns the entry after the one shown, or the draft after the last.
+func (h *history) next(current historyEntry) (historyEntry, bool) {
+	for i := h.pos + 1; i < len(h.entries); i++ {
+		if e := h.entries[i]; e.text() != current.text() {
+			h.pos = i
+			return e, true
+		}
+	}
+	if h.pos == len(h.entries) {
+		return historyEntry{}, false
+	}
+	h.pos = len(h.entries)
+	return h.draft, true
+}
+
+// fuzzyScore reports whether the runes of pattern appear in s in order, ignoring case,
+// and scores the match higher when they are closer together and nearer the start.
+func fuzzyScore(pattern, s string) (int, bool) {
+	pattern, s = strings.ToLower(pattern), strings.ToLower(s)
+	score, last := 0, -1
+	for _, r := range pattern {
+		i := strings.IndexRune(s[last+1:], r)
+		if i < 0 {
+			return 0, false
+		}
+		i += last + 1
+		if last >= 0 {
+			score -= i - last - 1
+		} else {
+			score -= i
+		}
+		last = i + utf8.RuneLen(r) - 1
+	}
+	return score, true
+}
+
+// searchHistory returns the distinct queries matching pattern, best and then latest first.
+func searchHistory(entries []historyEntry, pattern string) []historyEntry {
+	type match struct {
+		historyEntry
+		score int
+	}
+	var matches []match
+	seen := map[string]bool{}
+	for _, e := range slices.Backward(entries) {
+		if seen[e.text()] {
+			continue
+		}
+		seen[e.text()] = true
+		if score, ok := fuzzyScore(pattern, e.text()); ok {
+			matches = append(matches, match{e, score})
+		}
+	}
+	slices.SortStableFunc(matches, func(a, b match) int { return cmp.Compare(b.score, a.score) })
+
+	var rt []historyEntry
+	for _, m := range matches {
+		rt = append(rt, m.historyEntry)
+	}
+	return rt
+}
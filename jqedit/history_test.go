@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jqx", "history.jsonl")
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	must(0, appendHistory(path, historyEntry{at, ".a", "stdin", nil}))
+	must(0, appendHistory(path, historyEntry{at, ".b | keys", "a.json b.json", []string{".x"}}))
+
+	f := must(os.Open(path))
+	defer f.Close()
+	got := loadHistory(f)
+	assertEqual(t, fmt.Sprint(got), "[{2024-01-02 03:04:05 +0000 UTC .a stdin []} {2024-01-02 03:04:05 +0000 UTC .b | keys a.json b.json [.x]}]")
+
+	got = loadHistory(strings.NewReader("{\"query\":\".x\"}\nnot json\n{}\n" + strings.Repeat("{\"query\":\".y\"}\n", maxHistory)))
+	assertEqual(t, len(got), maxHistory)
+	assertEqual(t, got[0].Query, ".y")
+
+	// Past maxHistorySize, only the latest entries are kept
+	line := fmt.Sprintf("{\"query\":\".z # %s\"}\n", strings.Repeat("z", 500))
+	must(0, os.WriteFile(path, []byte(strings.Repeat(line, 2*maxHistory)), 0666))
+	must(0, appendHistory(path, historyEntry{at, ".last", "stdin", nil}))
+	b := must(os.ReadFile(path))
+	assertEqual(t, len(b) < maxHistorySize, true)
+	got = loadHistory(strings.NewReader(string(b)))
+	assertEqual(t, len(got), maxHistory)
+	assertEqual(t, got[len(got)-1].Query, ".last")
+}
+
+func TestHistoryRecall(t *testing.T) {
+	var h history
+	for _, q := range []string{".a", ".b", ".b", ".c"} {
+		h.add(historyEntry{Query: q})
+	}
+
+	var got []string
+	step := func(e historyEntry, ok bool) {
+		if !ok {
+			e.Query = "!"
+		}
+		got = append(got, e.Query)
+	}
+	q := func(code string) historyEntry { return historyEntry{Query: code} }
+	step(h.prev(q("draft")))
+	step(h.prev(q(".c")))
+	step(h.prev(q(".b")))
+	step(h.prev(q(".a")))
+	step(h.next(q(".a")))
+	step(h.next(q(".b")))
+	step(h.next(q(".c")))
+	step(h.next(q("draft")))
+	assertEqual(t, strings.Join(got, " "), ".c .b .a ! .b .c draft !")
+}
+
+func TestSearchHistory(t *testing.T) {
+	_, ok := fuzzyScore("mp", "map(.a)")
+	assertEqual(t, ok, true)
+	_, ok = fuzzyScore("pm", "map(.a)")
+	assertEqual(t, ok, false)
+
+	var entries []historyEntry
+	for _, q := range []string{"map(.a)", ".x | m | a | p", "keys", "map(.a)", "MaP(.b)"} {
+		entries = append(entries, historyEntry{Query: q})
+	}
+	var got []string
+	for _, e := range searchHistory(entries, "map") {
+		got = append(got, e.Query)
+	}
+	assertEqual(t, strings.Join(got, " ; "), "MaP(.b) ; map(.a) ; .x | m | a | p")
+	assertEqual(t, len(searchHistory(entries, "")), 4)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/atotto/clipboard"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// loadTimeout bounds how long loading an input may take, such as from a slow server.
+const loadTimeout = 10 * time.Second
+
+// loadedInput is an input loaded while jqedit runs, replacing stdin.
+// Each load makes a new one, so that queries see the change.
+type loadedInput struct {
+	name string
+	text string
+
+	load func(context.Context) (string, error)
+}
+
+func readURL(url string) func(context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return "", err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return "", fmt.Errorf("fetching %s: %s", url, resp.Status)
+		}
+		b, err := io.ReadAll(resp.Body)
+		return string(b), err
+	}
+}
+
+func readFile(name string) func(context.Context) (string, error) {
+	return func(context.Context) (string, error) {
+		b, err := os.ReadFile(name)
+		return string(b), err
+	}
+}
+
+func readClipboard(context.Context) (string, error) {
+	return clipboard.ReadAll()
+}
+
+// openInput loads arg, which is an http or https URL, or else a file name.
+func openInput(ctx context.Context, arg string) (*loadedInput, error) {
+	in := &loadedInput{name: arg, load: readFile(arg)}
+	if strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://") {
+		in.load = readURL(arg)
+	}
+	return in.reload(ctx)
+}
+
+// pasteInput loads the clipboard.
+func pasteInput(ctx context.Context) (*loadedInput, error) {
+	in := &loadedInput{name: "clipboard", load: readClipboard}
+	return in.reload(ctx)
+}
+
+// reload loads the input again from where it came from, such as after a file changes.
+func (in *loadedInput) reload(ctx context.Context) (*loadedInput, error) {
+	ctx, cancel := context.WithTimeout(ctx, loadTimeout)
+	defer cancel()
+	text, err := in.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil, fmt.Errorf("%s is empty", in.name)
+	}
+	return &loadedInput{in.name, text, in.load}, nil
+}
+
+// inputMsg delivers an input that was loaded.
+type inputMsg struct {
+	in  *loadedInput
+	err error
+}
+
+// loadCmd loads an input in the background.
+func loadCmd(load func(context.Context) (*loadedInput, error)) tea.Cmd {
+	return func() tea.Msg {
+		in, err := load(context.Background())
+		return inputMsg{in, err}
+	}
+}
+
+// openPrompt is the state of the prompt for a file name or URL to load,
+// or with find, for the directory that --find lists.
+type openPrompt struct {
+	text string
+	find bool
+}
+
+func (m model) updateOpen(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	p := *m.open
+	m.open = &p
+	switch msg.Type {
+	case tea.KeyEsc:
+		m.open = nil
+	case tea.KeyEnter:
+		m.open = nil
+		arg := strings.TrimSpace(p.text)
+		if p.find {
+			m.d.find = arg
+			setQuery(m.d)
+			return m, m.reloadInput()
+		}
+		if arg == "" {
+			return m, nil
+		}
+		return m, loadCmd(func(ctx context.Context) (*loadedInput, error) { return openInput(ctx, arg) })
+	case tea.KeyBackspace:
+		r := []rune(p.text)
+		p.text = string(r[:max(len(r)-1, 0)])
+	case tea.KeyRunes, tea.KeySpace:
+		p.text += string(msg.Runes)
+	}
+	return m, nil
+}
+
+func (m model) openView() string {
+	label := "open file or URL"
+	if m.open.find {
+		label = "--find directory"
+	}
+	return fmt.Sprintf("%s: %s", label, m.open.text) + cursorStyle.Render(" ")
+}
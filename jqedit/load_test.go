@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestOpenInput(t *testing.T) {
+	ctx := context.Background()
+	name := filepath.Join(t.TempDir(), "in.json")
+	must(0, os.WriteFile(name, []byte(`{"a":1}`), 0666))
+
+	in := must(openInput(ctx, name))
+	assertEqual(t, in.name, name)
+	assertEqual(t, in.text, `{"a":1}`)
+
+	must(0, os.WriteFile(name, []byte(`{"a":2}`), 0666))
+	again := must(in.reload(ctx))
+	assertEqual(t, again.text, `{"a":2}`)
+	assertEqual(t, again != in, true)
+
+	_, err := openInput(ctx, filepath.Join(t.TempDir(), "missing"))
+	assertEqual(t, err != nil, true)
+	must(0, os.WriteFile(name, nil, 0666))
+	_, err = in.reload(ctx)
+	assertEqual(t, fmt.Sprint(err), name+" is empty")
+}
+
+func TestOpenURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `[1,2]`)
+	}))
+	defer srv.Close()
+
+	in := must(openInput(context.Background(), srv.URL+"/api"))
+	assertEqual(t, in.text, `[1,2]`)
+	_, err := openInput(context.Background(), srv.URL+"/missing")
+	assertEqual(t, fmt.Sprint(err), "fetching "+srv.URL+"/missing: 404 Not Found")
+}
+
+func TestLoadedQuery(t *testing.T) {
+	d := data{code: ".[1]", loaded: &loadedInput{name: "clipboard", text: "[1,2]"}}
+	rt, err := d.query(context.Background())
+	assertEqual(t, err, nil)
+	assertEqual(t, rt, "2\n")
+	assertEqual(t, d.inputSource(), "clipboard")
+	assertEqual(t, d.filesMode(), false)
+}
+
+func TestFindPrompt(t *testing.T) {
+	defer func(f func(data)) { setQuery = f }(setQuery)
+	setQuery = func(data) {}
+
+	update := func(m model, msg tea.Msg) model {
+		t.Helper()
+		rt, _ := m.Update(msg)
+		return rt.(model)
+	}
+	m := update(newModel(data{}), toggleMsg('f'))
+	assertEqual(t, m.open.text, ".")
+	assertEqual(t, m.d.find, "")
+	m = update(m, tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("./x")})
+	assertEqual(t, m.openView(), "--find directory: ../x"+cursorStyle.Render(" "))
+	m = update(m, tea.KeyMsg{Type: tea.KeyEnter})
+	assertEqual(t, m.open == nil, true)
+	assertEqual(t, m.d.find, "../x")
+	assertEqual(t, strings.Contains(m.statusView(), "alt+f --find ../x"), true)
+
+	m = update(m, toggleMsg('f'))
+	assertEqual(t, m.open == nil, true)
+	assertEqual(t, m.d.find, "")
+}
@@ -3,17 +3,18 @@ package main
 import (
 	"bytes"
 	"cmp"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/fs"
-	"maps"
 	"os"
 	"path"
 	"runtime/debug"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/charmbracelet/bubbles/cursor"
@@ -30,38 +31,94 @@ const sampleJSON = `{"a":5,"b":"c","d":["e",true,-11.5,null,"f"],"g":{"h":"i","j
 
 var jqInput string
 var jqFiles []string
+var jqConfig fs.FS
+var jqCache jqx.Cache
+var jqHistory []historyEntry
+
+// inputSource describes the input of queries for the history.
+func (d data) inputSource() string {
+	switch {
+	case d.loaded != nil:
+		return d.loaded.name
+	case jqInput != "":
+		return "stdin"
+	case len(jqFiles) > 0:
+		return strings.Join(jqFiles, " ")
+	}
+	return "sample"
+}
 
 type data struct {
 	code string
+	// prefix is the earlier stages, whose outputs are the inputs of code
+	prefix string
+	// stages are the earlier stages that prefix joins, for the history
+	stages *[]string
+	// loaded replaces stdin, if an input was opened after startup
+	loaded *loadedInput
 
 	compact bool
 	raw     bool
+	json    bool
+	env     bool
+	slurp   bool
+	null    bool
+	find    string
+}
+
+// flags returns the jqx flags that are toggled on.
+func (d data) flags() []string {
+	var rt []string
+	add := func(on bool, flag ...string) {
+		if on {
+			rt = append(rt, flag...)
+		}
+	}
+	add(d.raw, "-r")
+	add(d.json, "-j")
+	add(d.env, "-e")
+	add(d.slurp, "-s")
+	add(d.null, "-n")
+	add(d.find != "", "--find", d.find)
+	return rt
+}
+
+// decodable returns d running code instead, with outputs that can be decoded as JSON.
+func (d data) decodable(code string) data {
+	d.code = code
+	d.compact = true
+	d.json = false
+	return d
 }
 
 func (d data) format() string {
-	code := d.code
-	parsed, err := gojq.Parse(code)
+	parsed, err := gojq.Parse(d.pipeline())
 	if err != nil {
 		return ""
 	}
-	code = parsed.String()
+	code := parsed.String()
 	if code == "" {
 		return ""
 	}
 	code = strings.ReplaceAll(code, `'`, `'\''`)
 	code = "'" + code + "'"
 
-	if d.raw {
-		code = "-r " + code
-	}
-
-	return "jqx " + code
+	return strings.Join(append([]string{"jqx"}, append(d.flags(), code)...), " ")
+}
+func (d data) query(ctx context.Context) (string, error) {
+	rt, _, err := d.run(ctx)
+	return rt, err
 }
-func (d data) query() (string, error) {
+
+// run returns the output of the query, along with the files it saves with snapshot.
+func (d data) run(ctx context.Context) (string, fs.FS, error) {
 	var output bytes.Buffer
 
 	filesVarInput := false
 	inputString := jqInput
+	if d.loaded != nil {
+		inputString = d.loaded.text
+	}
 	if inputString == "" {
 		inputString = sampleJSON
 		if len(jqFiles) > 0 {
@@ -70,25 +127,29 @@ func (d data) query() (string, error) {
 	}
 
 	prog := jqx.Program{
+		Context: ctx,
+
 		Stdin:   bytes.NewBufferString(inputString),
 		Println: func(s string) { fmt.Fprintln(&output, s) },
 		Open:    func(f string) (fs.File, error) { return os.Open(f) },
+		Find:    os.DirFS,
+		Config:  jqConfig,
+		Cache:   &jqCache,
 
 		StdinIsTerminal:  filesVarInput,
 		StdoutIsTerminal: !d.compact,
 	}
 
-	if d.raw {
-		prog.Args = append(prog.Args, "-r")
-	}
+	prog.Args = append(prog.Args, d.flags()...)
 
-	code := strings.TrimSpace(d.code)
+	code := strings.TrimSpace(d.pipeline())
 	if code == "" {
 		code = "."
 	}
 	prog.Args = append(prog.Args, code)
 	prog.Args = append(prog.Args, jqFiles...)
 
+	var files fs.FS
 	var err error
 	func() {
 		defer func() {
@@ -97,8 +158,12 @@ func (d data) query() (string, error) {
 				err = fmt.Errorf("query panic: %v", r)
 			}
 		}()
-		_, err = prog.Main()
+		files, err = prog.Main()
 	}()
+	if err != nil {
+		// What a failed run saved is incomplete
+		files = nil
+	}
 	rt := output.String()
 
 	if err == nil {
@@ -110,15 +175,150 @@ func (d data) query() (string, error) {
 		}
 	}
 
-	return rt, err
+	return rt, files, err
+}
+
+// inputValue returns the first input that queries see.
+func (d data) inputValue(ctx context.Context) (any, error) {
+	rt, err := d.decodable("tojson").query(ctx)
+	if err != nil {
+		return nil, err
+	}
+	line, _, _ := strings.Cut(rt, "\n")
+
+	var v any
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	err = decoder.Decode(&v)
+	return v, err
+}
+
+// queryLines runs code on the input and decodes each output as JSON, skipping any that are not.
+func (d data) queryLines(ctx context.Context, code string) []any {
+	rt, _ := d.decodable(code + " | tojson").query(ctx)
+	var lines []any
+	for line := range strings.Lines(rt) {
+		var v any
+		if json.Unmarshal([]byte(line), &v) == nil {
+			lines = append(lines, v)
+		}
+	}
+	return lines
+}
+
+// candidates lists the names that can be completed in a context of the given kind.
+func (d data) candidates(ctx context.Context, kind completionKind, base string) []string {
+	var rt []string
+	add := func(code string) {
+		for _, v := range d.queryLines(ctx, code) {
+			if s, ok := v.(string); ok {
+				rt = append(rt, s)
+			}
+		}
+	}
+
+	vars, funcs := queryNames(d.code)
+	switch kind {
+	case completeKey:
+		add(`[(` + base + `) | objects | keys[]] | unique[]`)
+	case completeVar:
+		add(`$vars | keys[]`)
+		rt = append(rt, "vars", "ENV")
+		rt = append(rt, vars...)
+	case completeFunc:
+		add(`builtins[]`)
+		rt = append(rt, jqx.Builtins()...)
+		rt = append(rt, configFuncs()...)
+		for i, name := range rt {
+			rt[i], _, _ = strings.Cut(name, "/")
+		}
+		rt = append(rt, funcs...)
+	}
+	return rt
+}
+
+// configFuncs lists the functions defined by the user's *.jq files.
+func configFuncs() []string {
+	if jqConfig == nil {
+		return nil
+	}
+	var rt []string
+	names, _ := fs.Glob(jqConfig, "*.jq")
+	for _, name := range names {
+		b, err := fs.ReadFile(jqConfig, name)
+		if err != nil {
+			continue
+		}
+		parsed, err := gojq.Parse(string(b))
+		if err != nil {
+			continue
+		}
+		for _, def := range parsed.FuncDefs {
+			rt = append(rt, def.Name)
+		}
+	}
+	return rt
 }
 
 type (
-	saveMsg func(string) error
-	tabMsg  struct{}
-	quitMsg struct{}
+	saveMsg       func(string) error
+	tabMsg        struct{}
+	treeMsg       struct{}
+	completeMsg   struct{}
+	searchMsg     struct{}
+	historyMsg    historyEntry
+	wrapMsg       struct{}
+	scrollMsg     int
+	findMsg       struct{}
+	splitMsg      struct{}
+	previewMsg    struct{}
+	helpMsg       struct{}
+	openMsg       struct{}
+	pasteMsg      struct{}
+	reloadMsg     struct{}
+	exportMsg     struct{}
+	cycleMsg      int
+	toggleMsg     byte
+	stageMsg      int
+	addStageMsg   struct{}
+	closeStageMsg struct{}
+	quitMsg       struct{}
 )
 
+// outputFind is the state of the search in the output.
+type outputFind struct {
+	pattern string
+	matches []match
+	current int
+}
+
+// historySearch is the state of the history search overlay.
+type historySearch struct {
+	pattern string
+	matches []historyEntry
+	cursor  int
+}
+
+// completion is the state of the completion popup.
+// all is nil until the candidates for kind and base have been loaded.
+type completion struct {
+	started bool
+	kind    completionKind
+	word    string
+	base    string
+
+	all    []string
+	shown  []string
+	cursor int
+}
+
+// candidatesMsg delivers the candidates loaded for a completion.
+type candidatesMsg struct {
+	kind completionKind
+	base string
+	all  []string
+}
+
 func init() {
 	textarea.DefaultKeyMap.WordForward = key.NewBinding(key.WithKeys("ctrl+right"))
 	textarea.DefaultKeyMap.WordBackward = key.NewBinding(key.WithKeys("ctrl+left"))
@@ -129,6 +329,35 @@ type model struct {
 	viewport viewport.Model
 	vcontent string
 
+	width, height int
+
+	tree      *tree
+	treeOpen  bool
+	treeFocus bool
+
+	complete *completion
+
+	history history
+	search  *historySearch
+
+	wrap    bool
+	xoffset int
+	find    *outputFind
+
+	input  *inputPane
+	inview viewport.Model
+
+	open *openPrompt
+
+	snapshots fs.FS
+	preview   *snapshotPanel
+
+	help bool
+
+	// stages holds the query of each stage, except the one being edited
+	stages []string
+	stage  int
+
 	d data
 
 	err error
@@ -139,6 +368,7 @@ func newModel(d data) model {
 		textarea: textarea.New(),
 		viewport: viewport.New(10, 10),
 		d:        d,
+		stages:   []string{""},
 	}
 
 	rt.textarea.SetHeight(4)
@@ -146,6 +376,8 @@ func newModel(d data) model {
 	rt.textarea.Focus()
 	rt.textarea.Cursor.SetMode(cursor.CursorStatic)
 
+	rt.history = history{entries: jqHistory, pos: len(jqHistory)}
+
 	return rt
 }
 func (m model) Init() tea.Cmd {
@@ -167,34 +399,15 @@ func doSave(contents string) error {
 	tPrintln("saved to " + tlink(outFile, "file://"+outFile))
 	return os.WriteFile(outFile, []byte(contents), 0666)
 }
-func doExport(contents string) error {
-	var fileObj map[string]string
-	err := json.Unmarshal([]byte(contents), &fileObj)
-	if err != nil {
-		return err
-	}
-
-	keys := slices.Sorted(maps.Keys(fileObj))
-	for _, k := range keys {
-		err := os.WriteFile(k, []byte(fileObj[k]), 0666)
-		if err != nil {
-			return err
-		}
-	}
-	tPrintln("exported to " + fmt.Sprint(keys))
-	return nil
-}
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case quitMsg:
 		return emptyModel{m}, tea.Quit
 	case tea.WindowSizeMsg:
-		width := msg.Width - Margin*2
-		m.textarea.SetWidth(width)
-		m.viewport.Width = width
-		m.viewport.Height = msg.Height - 15
-		m.viewportContent()
+		m.width = msg.Width - Margin*2
+		m.height = msg.Height
+		m.layout()
 		return m, nil
 	case tea.MouseMsg:
 		var cmd tea.Cmd
@@ -203,31 +416,568 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case saveMsg:
 		m.err = msg(m.vcontent)
 		return m, nil
-	case func() (string, error):
-		text, err := msg()
+	case func() (string, fs.FS, error):
+		text, files, err := msg()
 		m.err = err
 		if err == nil {
 			m.vcontent = text
 			m.viewportContent()
 		}
+		// Failed runs save nothing, so that ctrl+e cannot export stale files
+		m.snapshots = files
+		if m.preview != nil {
+			m.preview = newSnapshotPanel(files, m.preview.selected())
+		}
+		return m, m.syncInput()
+	case helpMsg:
+		m.help = !m.help
+		return m, nil
+	case previewMsg:
+		if m.preview != nil {
+			m.preview = nil
+		} else {
+			m.preview = newSnapshotPanel(m.snapshots, "")
+		}
+		return m, nil
+	case exportMsg:
+		files, err := snapshotFiles(m.snapshots, ".")
+		if err == nil {
+			var written []string
+			written, err = writeSnapshots(files, ".")
+			// Files written before a failure are reported along with it
+			if len(written) > 0 {
+				tPrintln("exported to " + fmt.Sprint(written))
+			}
+		}
+		m.err = err
+		if m.preview != nil {
+			m.preview = newSnapshotPanel(m.snapshots, m.preview.selected())
+		}
+		return m, nil
+	case splitMsg:
+		if m.input != nil {
+			m.input = nil
+			m.layout()
+			return m, nil
+		}
+		return m, m.inputValueCmd(true, false)
+	case inputValueMsg:
+		if msg.d.decodable("") != m.d.decodable("") {
+			// The input changed on the way, so find it again
+			return m, m.inputValueCmd(msg.split, msg.tree)
+		}
+		if msg.err != nil {
+			m.err = msg.err
+			return m, nil
+		}
+		if msg.tree {
+			m.treeOpen, m.treeFocus = true, true
+		}
+		if msg.tree || m.tree != nil {
+			m.tree = newTree(msg.v)
+		}
+		if msg.split {
+			m.inview = viewport.New(0, 0)
+		}
+		if msg.split || m.input != nil {
+			m.input = newInputPane(msg.v, m.d.filesMode())
+			m.inputContent()
+		}
+		m.layout()
+		return m, m.syncInput()
+	case cycleMsg:
+		if m.preview != nil {
+			m.preview.move(int(msg))
+		} else if m.input != nil {
+			m.input.cycle(int(msg))
+			m.inputContent()
+		}
+		return m, nil
+	case pathMsg:
+		if m.input != nil && msg.ok && msg.code == m.d.code {
+			line, ok := m.input.find(msg.path)
+			m.inputContent()
+			if ok {
+				m.inview.SetYOffset(line)
+			}
+		}
 		return m, nil
 
+	case treeMsg:
+		switch {
+		case !m.treeOpen:
+			if m.tree == nil {
+				return m, m.inputValueCmd(false, true)
+			}
+			m.treeOpen, m.treeFocus = true, true
+		case !m.treeFocus:
+			m.treeFocus = true
+		default:
+			m.treeOpen, m.treeFocus = false, false
+		}
+		m.layout()
+		return m, nil
+	case completeMsg:
+		m.complete = &completion{}
+		return m, m.updateCompletion()
+	case candidatesMsg:
+		c := m.complete
+		if c != nil && c.kind == msg.kind && c.base == msg.base {
+			c.all = msg.all
+			m.filterCompletion()
+		}
+		return m, nil
+	case historyMsg:
+		m.history.add(historyEntry(msg))
+		return m, nil
+	case searchMsg:
+		m.search = &historySearch{matches: searchHistory(m.history.entries, "")}
+		return m, nil
+	case wrapMsg:
+		m.wrap = !m.wrap
+		m.viewportContent()
+		return m, nil
+	case scrollMsg:
+		if !m.wrap {
+			m.xoffset = max(m.xoffset+int(msg), 0)
+			m.viewportContent()
+		}
+		return m, nil
+	case findMsg:
+		m.find = &outputFind{}
+		m.viewportContent()
+		return m, nil
+	case openMsg:
+		m.open = &openPrompt{}
+		return m, nil
+	case pasteMsg:
+		return m, loadCmd(pasteInput)
+	case reloadMsg:
+		if m.d.loaded == nil {
+			m.err = fmt.Errorf("nothing to reload: open a file or URL with alt+o, or paste with alt+v")
+			return m, nil
+		}
+		return m, loadCmd(m.d.loaded.reload)
+	case inputMsg:
+		if msg.err != nil {
+			m.err = msg.err
+			return m, nil
+		}
+		m.d.loaded = msg.in
+		setQuery(m.d)
+		tPrintln("input from " + msg.in.name)
+		return m, m.reloadInput()
+	case tea.KeyMsg:
+		if m.open != nil {
+			return m.updateOpen(msg)
+		}
+		if m.search != nil {
+			return m.updateSearch(msg)
+		}
+		if m.find != nil {
+			return m.updateFind(msg)
+		}
+		if m.treeFocus {
+			return m.updateTree(msg)
+		}
+		if m.complete != nil {
+			if m, cmd, ok := m.updateCompletionKey(msg); ok {
+				return m, cmd
+			}
+		}
+
+		switch {
+		case msg.Type == tea.KeyUp && m.textarea.Line() == 0:
+			if e, ok := m.history.prev(m.stageEntry()); ok {
+				return m, m.recall(e)
+			}
+		case msg.Type == tea.KeyDown && m.textarea.Line() == m.textarea.LineCount()-1:
+			if e, ok := m.history.next(m.stageEntry()); ok {
+				return m, m.recall(e)
+			}
+		}
+		m2, cmd := m.updateEditor(msg)
+		m = m2.(model)
+		if msg.String() == "." || msg.String() == "$" {
+			m.complete = &completion{}
+		}
+		if m.complete != nil {
+			cmd = tea.Batch(cmd, m.updateCompletion())
+		}
+		return m, cmd
+
 	// events that change the query
 	case tabMsg:
 		m.d.compact = !m.d.compact
 		setQuery(m.d)
 		return m, nil
+	case toggleMsg:
+		switch msg {
+		case 'r':
+			m.d.raw = !m.d.raw
+		case 'j':
+			m.d.json = !m.d.json
+		case 'e':
+			m.d.env = !m.d.env
+		case 's':
+			m.d.slurp = !m.d.slurp
+		case 'n':
+			m.d.null = !m.d.null
+		case 'f':
+			if m.d.find == "" {
+				m.open = &openPrompt{text: ".", find: true}
+				return m, nil
+			}
+			m.d.find = ""
+		}
+		setQuery(m.d)
+		return m, m.reloadInput()
+	case stageMsg:
+		i := (m.stage + int(msg) + len(m.stages)) % len(m.stages)
+		return m, m.setStage(i)
+	case addStageMsg:
+		return m, m.addStage()
+	case closeStageMsg:
+		return m, m.closeStage()
 	default:
-		var cmd tea.Cmd
-		m.textarea, cmd = m.textarea.Update(msg)
+		return m.updateEditor(msg)
+	}
+}
+
+func (m model) updateEditor(msg tea.Msg) (tea.Model, tea.Cmd) {
+	var cmd tea.Cmd
+	m.textarea, cmd = m.textarea.Update(msg)
+	m.d.code = m.textarea.Value()
+	setQuery(m.d)
+	return m, cmd
+}
+
+// reloadInput shows the input again in the tree and input pane, after a toggle changes it.
+func (m *model) reloadInput() tea.Cmd {
+	if m.tree == nil && m.input == nil {
+		return nil
+	}
+	return m.inputValueCmd(false, false)
+}
+
+// inputValueMsg delivers the input that queries see, to show in the tree and input pane.
+type inputValueMsg struct {
+	d   data
+	v   any
+	err error
+
+	// split and tree open the input pane and the tree, once the input is found
+	split, tree bool
+}
+
+// inputValueCmd finds the input that queries see in the background,
+// as the earlier stages that it goes through may take long or never end.
+func (m model) inputValueCmd(split, tree bool) tea.Cmd {
+	d := m.d
+	return func() tea.Msg {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		v, err := d.inputValue(ctx)
+		return inputValueMsg{d, v, err, split, tree}
+	}
+}
+
+// toggles are the flags switched with alt and their key, in the order they are shown.
+var toggles = []struct {
+	key  byte
+	flag string
+}{
+	{'r', "-r raw"},
+	{'j', "-j json"},
+	{'e', "-e env"},
+	{'s', "-s slurp"},
+	{'n', "-n null"},
+	{'f', "--find dir"},
+}
+
+// statusView shows the toggles, with those that are on stressed.
+func (m model) statusView() string {
+	on := m.d.flags()
+	var rt []string
+	for _, t := range toggles {
+		flag, _, _ := strings.Cut(t.flag, " ")
+		style := subtleStyle
+		if slices.Contains(on, flag) {
+			style = lipgloss.NewStyle().Bold(true)
+		}
+		label := t.flag
+		if t.key == 'f' && m.d.find != "" {
+			label = flag + " " + m.d.find
+		}
+		rt = append(rt, style.Render(fmt.Sprintf("alt+%c %s", t.key, label)))
+	}
+	rt = append(rt, subtleStyle.Render("F1 keys"))
+	return lipgloss.NewStyle().MaxWidth(m.width).Render(strings.Join(rt, "  "))
+}
+
+// setCode replaces the query, such as with one from the history.
+func (m *model) setCode(code string) {
+	m.textarea.SetValue(code)
+	m.d.code = code
+	setQuery(m.d)
+}
+
+// updateSearch edits the history search pattern, and recalls the selected query on enter.
+func (m model) updateSearch(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	s := *m.search
+	m.search = &s
+	switch msg.Type {
+	case tea.KeyEsc:
+		m.search = nil
+		return m, nil
+	case tea.KeyEnter:
+		m.search = nil
+		if len(s.matches) > 0 {
+			return m, m.recall(s.matches[s.cursor])
+		}
+		return m, nil
+	case tea.KeyUp:
+		s.cursor = max(s.cursor-1, 0)
+		return m, nil
+	case tea.KeyDown:
+		s.cursor = min(s.cursor+1, max(len(s.matches)-1, 0))
+		return m, nil
+	case tea.KeyBackspace:
+		r := []rune(s.pattern)
+		s.pattern = string(r[:max(len(r)-1, 0)])
+	case tea.KeyRunes, tea.KeySpace:
+		s.pattern += string(msg.Runes)
+	default:
+		return m, nil
+	}
+	s.matches = searchHistory(m.history.entries, s.pattern)
+	s.cursor = 0
+	return m, nil
+}
+
+func (m model) searchView() string {
+	s := m.search
+	lines := []string{"history: " + s.pattern}
+	start := min(max(s.cursor-m.viewport.Height+2, 0), len(s.matches))
+	for i, e := range s.matches[start:min(start+m.viewport.Height-1, len(s.matches))] {
+		code, _, _ := strings.Cut(e.text(), "\n")
+		line := e.Time.Local().Format("Jan _2 15:04") + "  " + code + "  " + commentStyle.Render(e.Input)
+		line = truncLines(line, m.viewport.Width)
+		if start+i == s.cursor {
+			line = selectedStyle.Render(line)
+		}
+		lines = append(lines, line)
+	}
+	return lipgloss.NewStyle().Height(m.viewport.Height).Render(strings.Join(lines, "\n"))
+}
+
+// updateCompletionKey handles the keys that choose a completion, reporting whether msg was one.
+func (m model) updateCompletionKey(msg tea.KeyMsg) (model, tea.Cmd, bool) {
+	c := *m.complete
+	m.complete = &c
+	switch msg.Type {
+	case tea.KeyUp:
+		c.cursor = max(c.cursor-1, 0)
+	case tea.KeyDown:
+		c.cursor = min(c.cursor+1, max(len(c.shown)-1, 0))
+	case tea.KeyEsc:
+		m.complete = nil
+	case tea.KeyTab, tea.KeyEnter:
+		if len(c.shown) == 0 {
+			return m, nil, msg.Type == tea.KeyTab
+		}
+		for range len([]rune(c.word)) {
+			m.textarea, _ = m.textarea.Update(tea.KeyMsg{Type: tea.KeyBackspace})
+		}
+		m.textarea.InsertString(completionText(c.kind, c.shown[c.cursor]))
+		m.complete = nil
 		m.d.code = m.textarea.Value()
 		setQuery(m.d)
-		return m, cmd
+	default:
+		return m, nil, false
 	}
+	return m, nil, true
 }
 
+// updateCompletion follows the cursor, loading new candidates when the context changes.
+func (m *model) updateCompletion() tea.Cmd {
+	kind, word, base, ok := completionContext(m.beforeCursor())
+	if !ok {
+		m.complete = nil
+		return nil
+	}
+
+	c := *m.complete
+	m.complete = &c
+	c.word = word
+	if c.started {
+		// Leaving the word being completed closes the popup
+		if c.kind != kind || c.base != base {
+			m.complete = nil
+		} else if c.all != nil {
+			m.filterCompletion()
+		}
+		return nil
+	}
+
+	c.started = true
+	c.kind, c.base = kind, base
+	d := m.d
+	return func() tea.Msg {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		return candidatesMsg{kind, base, d.candidates(ctx, kind, base)}
+	}
+}
+
+func (m *model) filterCompletion() {
+	c := m.complete
+	c.shown = filterCompletions(c.all, c.word)
+	c.cursor = min(c.cursor, max(len(c.shown)-1, 0))
+	if len(c.shown) == 0 {
+		m.complete = nil
+	}
+}
+
+// beforeCursor returns the query up to the cursor.
+func (m model) beforeCursor() string {
+	lines := strings.Split(m.textarea.Value(), "\n")
+	row := m.textarea.Line()
+	info := m.textarea.LineInfo()
+	line := []rune(lines[row])
+	col := min(info.StartColumn+info.ColumnOffset, len(line))
+	return strings.Join(append(lines[:row:row], string(line[:col])), "\n")
+}
+
+// completionView renders the popup, indented to line up with the cursor.
+func (m model) completionView() string {
+	const maxShown = 8
+
+	c := m.complete
+	if c == nil || len(c.shown) == 0 {
+		return ""
+	}
+
+	start := min(max(c.cursor-maxShown+1, 0), len(c.shown))
+	var lines []string
+	for i, s := range c.shown[start:min(start+maxShown, len(c.shown))] {
+		if start+i == c.cursor {
+			s = selectedStyle.Render(s)
+		}
+		lines = append(lines, s)
+	}
+
+	indent := lipgloss.Width(m.textarea.Prompt) + m.textarea.LineInfo().CharOffset
+	if m.textarea.ShowLineNumbers {
+		indent += len(strconv.Itoa(m.textarea.MaxHeight)) + 2
+	}
+	return popupStyle.MarginLeft(indent).Render(strings.Join(lines, "\n"))
+}
+
+// updateTree navigates the path explorer, and inserts the selected path into the query on enter.
+func (m model) updateTree(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "up", "k":
+		m.tree.move(-1)
+	case "down", "j":
+		m.tree.move(1)
+	case "pgup":
+		m.tree.move(-m.viewport.Height)
+	case "pgdown":
+		m.tree.move(m.viewport.Height)
+	case "right", "l":
+		m.tree.expand()
+	case "left", "h":
+		m.tree.collapse()
+	case " ":
+		n := m.tree.selected()
+		n.setOpen(!n.open)
+	case "enter":
+		m.treeFocus = false
+		m.textarea.InsertString(pathString(m.tree.selected().path()))
+		m.d.code = m.textarea.Value()
+		setQuery(m.d)
+	}
+	return m, nil
+}
+
+// layout sizes the panes to fit the window.
+func (m *model) layout() {
+	m.textarea.SetWidth(m.width)
+	m.viewport.Width = m.width
+	m.viewport.Height = m.height - 16
+	if len(m.stages) > 1 {
+		m.viewport.Height--
+	}
+	if m.treeOpen {
+		m.viewport.Width -= m.treeWidth() + 1
+	}
+	if m.input != nil {
+		m.inview.Width = m.viewport.Width / 2
+		m.inview.Height = m.viewport.Height - 1
+		m.viewport.Width -= m.inview.Width + 1
+		m.inputContent()
+	}
+	m.viewportContent()
+}
+
+func (m model) treeWidth() int {
+	return m.width / 3
+}
+
+// viewportContent lays out the output, wrapped or scrolled horizontally,
+// and marks what is being searched for, scrolling to the current match.
 func (m *model) viewportContent() {
-	m.viewport.SetContent(truncLines(m.vcontent, m.viewport.Width))
+	lines := strings.Split(cleanText(m.vcontent), "\n")
+	width := m.viewport.Width
+
+	f := m.find
+	if f == nil || f.pattern == "" {
+		rows, _ := renderLines(lines, nil, 0, layout{width, m.wrap, m.xoffset}, matchStyle, currentMatchStyle)
+		m.viewport.SetContent(highlightOutput(strings.Join(rows, "\n")))
+		return
+	}
+
+	f.matches = findMatches(lines, f.pattern)
+	if len(f.matches) == 0 {
+		f.current = 0
+	} else {
+		f.current = (f.current%len(f.matches) + len(f.matches)) % len(f.matches)
+		if c := f.matches[f.current]; !m.wrap && (c.col < m.xoffset || c.col+c.len > m.xoffset+width) {
+			m.xoffset = max(c.col-width/3, 0)
+		}
+	}
+
+	rows, currentRow := renderLines(lines, f.matches, f.current, layout{width, m.wrap, m.xoffset}, matchStyle, currentMatchStyle)
+	m.viewport.SetContent(strings.Join(rows, "\n"))
+	if len(f.matches) > 0 && (currentRow < m.viewport.YOffset || currentRow >= m.viewport.YOffset+m.viewport.Height) {
+		m.viewport.SetYOffset(currentRow - m.viewport.Height/2)
+	}
+}
+
+// updateFind edits the search in the output, and moves between matches with enter, up and down.
+func (m model) updateFind(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	f := *m.find
+	m.find = &f
+	switch msg.Type {
+	case tea.KeyEsc:
+		m.find = nil
+	case tea.KeyEnter, tea.KeyDown:
+		f.current++
+	case tea.KeyUp:
+		f.current--
+	case tea.KeyBackspace:
+		r := []rune(f.pattern)
+		f.pattern = string(r[:max(len(r)-1, 0)])
+		f.current = 0
+	case tea.KeyRunes, tea.KeySpace:
+		f.pattern += string(msg.Runes)
+		f.current = 0
+	default:
+		return m, nil
+	}
+	m.viewportContent()
+	return m, nil
 }
 
 var (
@@ -239,10 +989,42 @@ var (
 	commentStyle = lipgloss.Style{}.
 			Italic(true).
 			Foreground(lipgloss.Color("#888888"))
+	selectedStyle = lipgloss.Style{}.
+			Reverse(true)
+	popupStyle = lipgloss.Style{}.
+			Border(lipgloss.NormalBorder()).
+			BorderForeground(lipgloss.Color("#888888"))
+	matchStyle = lipgloss.Style{}.
+			Background(lipgloss.Color("#fff3a0"))
+	currentMatchStyle = lipgloss.Style{}.
+				Background(lipgloss.Color("#ffa657"))
+	addedStyle = lipgloss.Style{}.
+			Foreground(lipgloss.Color("#116329"))
+	removedStyle = lipgloss.Style{}.
+			Foreground(lipgloss.Color("#cf222e"))
 )
 
 func (m model) View() string {
 	viewport := m.viewport.View()
+	if m.preview != nil {
+		viewport = lipgloss.NewStyle().Width(m.viewport.Width).Height(m.viewport.Height).
+			Render(m.preview.view(m.viewport.Width, m.viewport.Height))
+	}
+	if m.search != nil {
+		viewport = m.searchView()
+	}
+	if m.help {
+		viewport = m.helpView()
+	}
+	if m.input != nil {
+		pane := lipgloss.JoinVertical(lipgloss.Left, subtleStyle.Render(m.input.title()), m.inview.View())
+		viewport = lipgloss.JoinHorizontal(lipgloss.Top, pane, " ", viewport)
+	}
+	if m.treeOpen {
+		tree := m.tree.view(m.treeWidth(), m.viewport.Height, m.treeFocus)
+		tree = lipgloss.NewStyle().Height(m.viewport.Height).Render(tree)
+		viewport = lipgloss.JoinHorizontal(lipgloss.Top, tree, " ", viewport)
+	}
 
 	err := ""
 	if m.err != nil {
@@ -250,14 +1032,36 @@ func (m model) View() string {
 	}
 
 	hr := subtleStyle.Render(strings.Repeat("─", 8))
+	bottom := hr
+	if f := m.find; f != nil {
+		n := 0
+		if len(f.matches) > 0 {
+			n = f.current + 1
+		}
+		bottom = fmt.Sprintf("find: %s  (%d/%d)", f.pattern, n, len(f.matches))
+	} else if m.xoffset > 0 && !m.wrap {
+		bottom = subtleStyle.Render(fmt.Sprintf("──── →%d ────", m.xoffset))
+	}
+
+	status := m.statusView()
+	if m.open != nil {
+		status = m.openView()
+	}
 
 	mainView := lipgloss.JoinVertical(lipgloss.Center,
 		hr,
 		viewport,
-		hr,
+		bottom,
 
-		m.textarea.View(),
+		m.editorView(),
+		status,
 	)
+	if tabs := m.stagesView(); tabs != "" {
+		mainView = lipgloss.JoinVertical(lipgloss.Center, mainView, tabs)
+	}
+	if popup := m.completionView(); popup != "" {
+		mainView = lipgloss.JoinVertical(lipgloss.Left, mainView, popup)
+	}
 	mainView = lipgloss.JoinHorizontal(lipgloss.Center,
 		strings.Repeat(" ", Margin-1),
 		mainView,
@@ -300,18 +1104,108 @@ func isTerminal(f fs.File) bool {
 	return stat.Mode()&fs.ModeCharDevice != 0
 }
 
+// keyHelp lists the keys that msgFilter binds, and the others the editor takes, to show with F1.
+var keyHelp = [][2]string{
+	{"F1", "show or hide these keys"},
+	{"esc ctrl+c ctrl+q", "quit, or close the prompt or popup that is open"},
+	{"up down", "recall earlier queries, from the first or last line"},
+	{"ctrl+r", "search earlier queries"},
+	{"ctrl+@", "complete keys, variables and functions"},
+	{"tab", "switch between compact and indented output"},
+	{"ctrl+f", "find in the output; enter and up move between matches"},
+	{"alt+w", "wrap long output lines"},
+	{"alt+left alt+right", "scroll long output lines"},
+	{"ctrl+s", "save the output to a file"},
+	{"ctrl+t", "open, focus, or close the input tree"},
+	{"ctrl+l", "show the input beside the output"},
+	{"alt+up alt+down", "switch the input file, or the snapshot file"},
+	{"ctrl+o", "preview the files the query saves with snapshot"},
+	{"ctrl+e", "write the files the query saves with snapshot"},
+	{"alt+r alt+j alt+e alt+s alt+n", "toggle -r, -j, -e, -s and -n"},
+	{"alt+f", "toggle --find, prompting for the directory"},
+	{"alt+o", "open a file or URL as the input"},
+	{"alt+v", "paste the input from the clipboard"},
+	{"alt+g", "reload the input"},
+	{"alt+t", "add a stage after this one, taking its outputs"},
+	{"alt+x", "close this stage"},
+	{"alt+, alt+.", "switch to the previous or next stage"},
+}
+
+// helpView lists the keys, in place of the output.
+func (m model) helpView() string {
+	width := 0
+	for _, k := range keyHelp {
+		width = max(width, len(k[0]))
+	}
+	var lines []string
+	for _, k := range keyHelp {
+		lines = append(lines, cropLine(fmt.Sprintf("%-*s  %s", width, k[0], k[1]), 0, m.viewport.Width))
+	}
+	return lipgloss.NewStyle().Width(m.viewport.Width).Height(m.viewport.Height).Render(strings.Join(lines, "\n"))
+}
+
 func msgFilter(m tea.Model, msg tea.Msg) tea.Msg {
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
+		// The completion popup and searches take these keys while they are open
+		if m, ok := m.(model); ok && (m.complete != nil || m.search != nil || m.find != nil || m.open != nil) {
+			switch msg.Type {
+			case tea.KeyEsc, tea.KeyTab, tea.KeyEnter:
+				return msg
+			}
+		}
+
 		switch msg.Type {
 		case tea.KeyEsc, tea.KeyCtrlC, tea.KeyCtrlQ:
 			return quitMsg{}
 		case tea.KeyCtrlS:
 			return saveMsg(doSave)
 		case tea.KeyCtrlE:
-			return saveMsg(doExport)
+			return exportMsg{}
 		case tea.KeyTab:
 			return tabMsg{}
+		case tea.KeyCtrlT:
+			return treeMsg{}
+		case tea.KeyCtrlAt:
+			return completeMsg{}
+		case tea.KeyCtrlR:
+			return searchMsg{}
+		case tea.KeyCtrlF:
+			return findMsg{}
+		case tea.KeyCtrlL:
+			return splitMsg{}
+		case tea.KeyCtrlO:
+			return previewMsg{}
+		case tea.KeyF1:
+			return helpMsg{}
+		}
+		switch msg.String() {
+		case "alt+w":
+			return wrapMsg{}
+		case "alt+left":
+			return scrollMsg(-8)
+		case "alt+right":
+			return scrollMsg(8)
+		case "alt+r", "alt+j", "alt+e", "alt+s", "alt+n", "alt+f":
+			return toggleMsg(msg.Runes[0])
+		case "alt+o":
+			return openMsg{}
+		case "alt+v":
+			return pasteMsg{}
+		case "alt+g":
+			return reloadMsg{}
+		case "alt+t":
+			return addStageMsg{}
+		case "alt+x":
+			return closeStageMsg{}
+		case "alt+,":
+			return stageMsg(-1)
+		case "alt+.":
+			return stageMsg(1)
+		case "alt+up":
+			return cycleMsg(-1)
+		case "alt+down":
+			return cycleMsg(1)
 		}
 	}
 	return msg
@@ -336,9 +1230,16 @@ func main() {
 		jqInput = string(must(io.ReadAll(os.Stdin)))
 	}
 	jqFiles = os.Args[1:]
-	if _, err := d.query(); err != nil {
+	if dir, err := os.UserConfigDir(); err == nil {
+		jqConfig = os.DirFS(path.Join(dir, "jqx"))
+	}
+	if _, err := d.query(context.Background()); err != nil {
 		d.raw = true
 	}
+	if f, err := os.Open(historyPath()); err == nil {
+		jqHistory = loadHistory(f)
+		f.Close()
+	}
 
 	lipgloss.SetDefaultRenderer(lipgloss.NewRenderer(os.Stderr))
 
@@ -370,24 +1271,50 @@ func main() {
 	}
 }
 
+// queryThread runs each new query as it arrives,
+// cancelling the previous one if it is still running.
 func queryThread(send func(tea.Msg), wait func(*data)) {
 	d := data{code: ".  #placeholder..."}
 	var logged = map[string]bool{"": true}
 
+	var mu sync.Mutex
+	cancel := func() {}
+
 	for {
 		wait(&d)
 
-		rt, err := d.query()
-		if err == nil {
-			log := d.format()
-			if !logged[log] {
-				tPrintln(log)
+		mu.Lock()
+		cancel()
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		mu.Unlock()
+
+		go func(d data) {
+			rt, files, err := d.run(ctx)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err == nil {
+				log := d.format()
+				if !logged[log] {
+					tPrintln(log)
+
+					entry := d.historyEntry(time.Now())
+					if err := appendHistory(historyPath(), entry); err != nil {
+						tPrintln(err)
+					}
+					send(historyMsg(entry))
+				}
+				logged[log] = true
 			}
-			logged[log] = true
-		}
 
-		send(func() (string, error) {
-			return rt, err
-		})
+			send(func() (string, fs.FS, error) {
+				return rt, files, err
+			})
+		}(d)
 	}
 }
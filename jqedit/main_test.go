@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestFormat(t *testing.T) {
+	assertEqual(t, data{code: ".a"}.format(), "jqx '.a'")
+	assertEqual(t, data{code: "|"}.format(), "")
+	assertEqual(t, data{code: `"it's"`}.format(), `jqx '"it'\''s"'`)
+	assertEqual(t, data{code: ".a", raw: true, json: true, slurp: true}.format(), "jqx -r -j -s '.a'")
+	assertEqual(t, data{code: "$find", env: true, null: true, find: "."}.format(), "jqx -e -n --find . '$find'")
+}
+
+func TestToggles(t *testing.T) {
+	query := func(d data) string {
+		t.Helper()
+		d.compact = true
+		rt, err := d.query(context.Background())
+		if err != nil {
+			return "error"
+		}
+		return rt
+	}
+	assertEqual(t, query(data{code: ".b"}), "c\n")
+	assertEqual(t, query(data{code: ".b", json: true}), "\"c\"\n")
+	assertEqual(t, query(data{code: ".[0].a", slurp: true}), "5\n")
+	assertEqual(t, query(data{code: ". == null", null: true}), "true\n")
+	assertEqual(t, query(data{code: "$env | type"}), "error")
+	assertEqual(t, query(data{code: "$env | type", env: true}), "object\n")
+	assertEqual(t, query(data{code: `$find | has("main.go")`, find: "."}), "true\n")
+
+	v, err := data{slurp: true, json: true}.inputValue(context.Background())
+	assertEqual(t, err, nil)
+	assertEqual(t, len(v.([]any)), 1)
+}
+
+func TestKeyHelp(t *testing.T) {
+	assertEqual(t, msgFilter(model{}, tea.KeyMsg{Type: tea.KeyF1}), tea.Msg(helpMsg{}))
+
+	// Every key that msgFilter binds is listed
+	var listed []string
+	for _, k := range keyHelp {
+		listed = append(listed, strings.Fields(k[0])...)
+	}
+	for _, key := range []string{"ctrl+s", "ctrl+e", "ctrl+t", "ctrl+@", "ctrl+r", "ctrl+f", "ctrl+l", "ctrl+o",
+		"alt+w", "alt+left", "alt+right", "alt+f", "alt+o", "alt+v", "alt+g", "alt+t", "alt+x", "alt+,", "alt+.", "alt+up", "alt+down"} {
+		if !slices.Contains(listed, key) {
+			t.Errorf("%s is not listed", key)
+		}
+	}
+
+	m := newModel(data{})
+	m.viewport.Width, m.viewport.Height = 80, 30
+	assertEqual(t, strings.Contains(m.helpView(), "ctrl+f"), true)
+	assertEqual(t, strings.Contains(m.statusView(), "F1 keys"), true)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxDiff bounds the work done to diff a file, as diffing is quadratic.
+const maxDiff = 1 << 22
+
+// snapshotFile is a file that the query saves with snapshot, and what is on disk in its place.
+type snapshotFile struct {
+	name    string
+	content string
+
+	old    string
+	exists bool
+}
+
+// snapshotFiles lists the files in fsys, reading what they would replace under root.
+func snapshotFiles(fsys fs.FS, root string) ([]snapshotFile, error) {
+	if fsys == nil {
+		return nil, nil
+	}
+	var rt []snapshotFile
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		f := snapshotFile{name: name, content: string(b)}
+		old, err := os.ReadFile(filepath.Join(root, name))
+		if err == nil {
+			f.old, f.exists = string(old), true
+		}
+		rt = append(rt, f)
+		return nil
+	})
+	return rt, err
+}
+
+func (f snapshotFile) status() string {
+	switch {
+	case !f.exists:
+		return "new"
+	case f.old != f.content:
+		return "changed"
+	}
+	return "unchanged"
+}
+
+// diffLines compares the lines of a and b, prefixing those only in a with "-",
+// those only in b with "+", and those in both with a space.
+func diffLines(a, b []string) []string {
+	if len(a)*len(b) > maxDiff {
+		var rt []string
+		for _, line := range a {
+			rt = append(rt, "-"+line)
+		}
+		for _, line := range b {
+			rt = append(rt, "+"+line)
+		}
+		return rt
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var rt []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			rt = append(rt, " "+a[i])
+			i, j = i+1, j+1
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			rt = append(rt, "-"+a[i])
+			i++
+		default:
+			rt = append(rt, "+"+b[j])
+			j++
+		}
+	}
+	return rt
+}
+
+// diff shows the content of a new file, or how it changes the one on disk.
+func (f snapshotFile) diff() []string {
+	lines := strings.Split(f.content, "\n")
+	if !f.exists {
+		return diffLines(nil, lines)
+	}
+	return diffLines(strings.Split(f.old, "\n"), lines)
+}
+
+// writeSnapshots writes the files that are new or changed under root, and returns their names.
+func writeSnapshots(files []snapshotFile, root string) ([]string, error) {
+	var written []string
+	for _, f := range files {
+		if f.status() == "unchanged" {
+			continue
+		}
+		name := filepath.Join(root, f.name)
+		err := os.MkdirAll(filepath.Dir(name), 0777)
+		if err != nil {
+			return written, err
+		}
+		err = os.WriteFile(name, []byte(f.content), 0666)
+		if err != nil {
+			return written, err
+		}
+		written = append(written, f.name)
+	}
+	return written, nil
+}
+
+// snapshotPanel previews the files that the query saves, in place of the output.
+type snapshotPanel struct {
+	files  []snapshotFile
+	cursor int
+	err    error
+
+	// diff is that of the selected file, kept as it is slow to compute for every frame
+	diff []string
+}
+
+func newSnapshotPanel(fsys fs.FS, selected string) *snapshotPanel {
+	p := &snapshotPanel{}
+	p.files, p.err = snapshotFiles(fsys, ".")
+	for i, f := range p.files {
+		if f.name == selected {
+			p.cursor = i
+		}
+	}
+	if len(p.files) > 0 {
+		p.diff = p.files[p.cursor].diff()
+	}
+	return p
+}
+
+func (p *snapshotPanel) selected() string {
+	if len(p.files) == 0 {
+		return ""
+	}
+	return p.files[p.cursor].name
+}
+
+func (p *snapshotPanel) move(delta int) {
+	if len(p.files) > 0 {
+		p.cursor = (p.cursor + delta + len(p.files)) % len(p.files)
+		p.diff = p.files[p.cursor].diff()
+	}
+}
+
+var statusMarks = map[string]string{"new": "+", "changed": "~", "unchanged": " "}
+
+// view lists the files, with the diff of the selected one below them,
+// scrolled to its first change.
+func (p *snapshotPanel) view(width, height int) string {
+	switch {
+	case p.err != nil:
+		return p.err.Error()
+	case len(p.files) == 0:
+		return subtleStyle.Render("no snapshots")
+	}
+
+	var list []string
+	for i, f := range p.files {
+		row := cropLine(fmt.Sprintf("%s %s (%s)", statusMarks[f.status()], f.name, f.status()), 0, width)
+		if i == p.cursor {
+			row = selectedStyle.Render(row)
+		}
+		list = append(list, row)
+	}
+	list = list[max(min(p.cursor-height/4, len(list)-height/2), 0):]
+	list = list[:min(len(list), max(height/2, 1))]
+
+	diff := p.diff
+	first := 0
+	for i, line := range diff {
+		if line[0] != ' ' {
+			first = i
+			break
+		}
+	}
+	diff = diff[max(first-2, 0):]
+
+	rows := append(list, subtleStyle.Render(strings.Repeat("─", 8)))
+	for _, line := range diff[:min(len(diff), max(height-len(rows), 0))] {
+		row := cropLine(cleanText(line), 0, width)
+		switch line[0] {
+		case '+':
+			row = addedStyle.Render(row)
+		case '-':
+			row = removedStyle.Render(row)
+		}
+		rows = append(rows, row)
+	}
+	return strings.Join(rows, "\n")
+}
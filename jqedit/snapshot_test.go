@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestDiffLines(t *testing.T) {
+	diff := func(a, b string) string {
+		return strings.Join(diffLines(strings.Split(a, " "), strings.Split(b, " ")), " ")
+	}
+	assertEqual(t, diff("a b c", "a b c"), " a  b  c")
+	assertEqual(t, diff("a b c", "a x c"), " a -b +x  c")
+	assertEqual(t, diff("a b c", "b c d"), "-a  b  c +d")
+	assertEqual(t, strings.Join(diffLines(nil, []string{"a"}), " "), "+a")
+}
+
+func TestSnapshotFiles(t *testing.T) {
+	root := t.TempDir()
+	must(0, os.WriteFile(filepath.Join(root, "same"), []byte("1"), 0666))
+	must(0, os.WriteFile(filepath.Join(root, "changed"), []byte("1\n2"), 0666))
+
+	fsys := fstest.MapFS{
+		"same":    {Data: []byte("1")},
+		"changed": {Data: []byte("1\n3")},
+		"dir/new": {Data: []byte("4")},
+	}
+	files := must(snapshotFiles(fsys, root))
+	var got []string
+	for _, f := range files {
+		got = append(got, f.name+" "+f.status()+" "+strings.Join(f.diff(), ","))
+	}
+	assertEqual(t, strings.Join(got, " | "), "changed changed  1,-2,+3 | dir/new new +4 | same unchanged  1")
+
+	written := must(writeSnapshots(files, root))
+	assertEqual(t, strings.Join(written, " "), "changed dir/new")
+	assertEqual(t, string(must(os.ReadFile(filepath.Join(root, "dir/new")))), "4")
+	for _, f := range must(snapshotFiles(fsys, root)) {
+		assertEqual(t, f.status(), "unchanged")
+	}
+}
+
+func TestSnapshotPanel(t *testing.T) {
+	p := newSnapshotPanel(nil, "")
+	assertEqual(t, p.view(20, 5), "no snapshots")
+	assertEqual(t, p.selected(), "")
+
+	fsys := fstest.MapFS{"a": {Data: []byte("x")}, "b": {Data: []byte("y\nz")}}
+	p = newSnapshotPanel(fsys, "b")
+	assertEqual(t, p.selected(), "b")
+	assertEqual(t, strings.Join(p.diff, ","), "+y,+z")
+	p.move(1)
+	assertEqual(t, p.selected(), "a")
+	assertEqual(t, strings.Join(p.diff, ","), "+x")
+}
+
+func TestRunSnapshots(t *testing.T) {
+	_, files, err := data{code: `snapshot("out.txt"; .b) | .a`}.run(context.Background())
+	assertEqual(t, err, nil)
+	assertEqual(t, string(must(fs.ReadFile(files, "out.txt"))), "c")
+
+	_, files, err = data{code: `snapshot("out.txt"; .b) | error`}.run(context.Background())
+	assertEqual(t, err != nil, true)
+	assertEqual(t, files, nil)
+}
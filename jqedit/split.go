@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// renderJSON indents v like jqx -t, with keys sorted,
+// and records the line that each path in it starts on.
+func renderJSON(v any) (text string, lines map[string]int) {
+	var b strings.Builder
+	lines = map[string]int{}
+	line := 0
+
+	var render func(v any, path []any, depth int)
+	render = func(v any, path []any, depth int) {
+		lines[pathString(path)] = line
+		indent := strings.Repeat("\t", depth)
+		newline := func() {
+			b.WriteString("\n" + indent)
+			line++
+		}
+
+		switch v := v.(type) {
+		case map[string]any:
+			if len(v) == 0 {
+				b.WriteString("{}")
+				return
+			}
+			b.WriteString("{")
+			for i, k := range slices.Sorted(maps.Keys(v)) {
+				if i > 0 {
+					b.WriteString(",")
+				}
+				newline()
+				b.WriteString("\t" + string(must(json.Marshal(k))) + ": ")
+				render(v[k], append(path[:len(path):len(path)], k), depth+1)
+			}
+			newline()
+			b.WriteString("}")
+		case []any:
+			if len(v) == 0 {
+				b.WriteString("[]")
+				return
+			}
+			b.WriteString("[")
+			for i, e := range v {
+				if i > 0 {
+					b.WriteString(",")
+				}
+				newline()
+				b.WriteString("\t")
+				render(e, append(path[:len(path):len(path)], i), depth+1)
+			}
+			newline()
+			b.WriteString("]")
+		default:
+			b.WriteString(string(must(json.Marshal(v))))
+		}
+	}
+	render(v, nil, 0)
+	return b.String(), lines
+}
+
+// decodePath converts a path decoded from JSON, whose indices are numbers, for use with pathString.
+func decodePath(v any) ([]any, bool) {
+	elems, ok := v.([]any)
+	if !ok {
+		return nil, false
+	}
+	var rt []any
+	for _, e := range elems {
+		switch e := e.(type) {
+		case string:
+			rt = append(rt, e)
+		case float64:
+			rt = append(rt, int(e))
+		default:
+			return nil, false
+		}
+	}
+	return rt, true
+}
+
+// filesMode reports whether queries take $files as their input, as there is no stdin.
+func (d data) filesMode() bool {
+	return d.loaded == nil && jqInput == "" && len(jqFiles) > 0
+}
+
+// queryPath returns the path in the input of the first output of the query,
+// if the query is a path expression such as .d[2].
+func (d data) queryPath(ctx context.Context) ([]any, bool) {
+	code := strings.TrimSpace(d.code)
+	if code == "" {
+		return nil, true
+	}
+	lines := d.queryLines(ctx, "first(path(\n"+code+"\n))")
+	if len(lines) == 0 {
+		return nil, false
+	}
+	return decodePath(lines[0])
+}
+
+// inputPane shows the input beside the output.
+// In files mode, it shows one file at a time.
+type inputPane struct {
+	doc   any
+	files []string
+	file  int
+
+	text  string
+	lines map[string]int
+}
+
+func newInputPane(doc any, filesMode bool) *inputPane {
+	p := &inputPane{doc: doc}
+	if files, ok := doc.(map[string]any); ok && filesMode {
+		p.files = slices.Sorted(maps.Keys(files))
+	}
+	p.render()
+	return p
+}
+
+func (p *inputPane) shown() any {
+	if p.files == nil {
+		return p.doc
+	}
+	return p.doc.(map[string]any)[p.files[p.file]]
+}
+
+func (p *inputPane) render() {
+	p.text, p.lines = renderJSON(p.shown())
+}
+
+func (p *inputPane) title() string {
+	if p.files == nil {
+		return "input"
+	}
+	return fmt.Sprintf("%s (%d/%d)", p.files[p.file], p.file+1, len(p.files))
+}
+
+// cycle shows another file, in files mode.
+func (p *inputPane) cycle(delta int) {
+	if len(p.files) == 0 {
+		return
+	}
+	p.file = (p.file + delta + len(p.files)) % len(p.files)
+	p.render()
+}
+
+// find returns the line of path, which in files mode starts with the name of a file.
+// It switches to that file, and falls back to the longest prefix of path that is shown.
+func (p *inputPane) find(path []any) (int, bool) {
+	if p.files != nil {
+		if len(path) == 0 {
+			return 0, false
+		}
+		name, _ := path[0].(string)
+		i := slices.Index(p.files, name)
+		if i < 0 {
+			return 0, false
+		}
+		if i != p.file {
+			p.file = i
+			p.render()
+		}
+		path = path[1:]
+	}
+
+	for n := len(path); n >= 0; n-- {
+		if line, ok := p.lines[pathString(path[:n])]; ok {
+			return line, true
+		}
+	}
+	return 0, false
+}
+
+// pathMsg delivers the path of the output of code, to scroll the input pane to.
+type pathMsg struct {
+	code string
+	path []any
+	ok   bool
+}
+
+func (m model) syncInput() tea.Cmd {
+	if m.input == nil {
+		return nil
+	}
+	d := m.d
+	return func() tea.Msg {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		path, ok := d.queryPath(ctx)
+		return pathMsg{d.code, path, ok}
+	}
+}
+
+func (m *model) inputContent() {
+	p := m.input
+	lines := strings.Split(cleanText(p.text), "\n")
+	rows, _ := renderLines(lines, nil, 0, layout{width: m.inview.Width}, matchStyle, currentMatchStyle)
+	m.inview.SetContent(highlightOutput(strings.Join(rows, "\n")))
+}
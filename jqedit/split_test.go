@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRenderJSON(t *testing.T) {
+	var v any
+	must(0, json.Unmarshal([]byte(sampleJSON), &v))
+	text, lines := renderJSON(v)
+
+	var want any
+	must(0, json.Unmarshal([]byte(text), &want))
+	assertEqual(t, fmt.Sprint(want), fmt.Sprint(v))
+	assertEqual(t, strings.Split(text, "\n")[6], "\t\t-11.5,")
+
+	assertEqual(t, lines["."], 0)
+	assertEqual(t, lines[".b"], 2)
+	assertEqual(t, lines[".d"], 3)
+	assertEqual(t, lines[".d[2]"], 6)
+	assertEqual(t, lines[".g"], 10)
+	assertEqual(t, lines[".g.h"], 11)
+	assertEqual(t, lines[".l"], 14)
+
+	text, lines = renderJSON(map[string]any{"a": []any{}})
+	assertEqual(t, text, "{\n\t\"a\": []\n}")
+	assertEqual(t, len(lines), 2)
+}
+
+func TestDecodePath(t *testing.T) {
+	path, ok := decodePath([]any{"d", 2.0})
+	assertEqual(t, ok, true)
+	assertEqual(t, pathString(path), ".d[2]")
+
+	_, ok = decodePath([]any{"d", nil})
+	assertEqual(t, ok, false)
+	_, ok = decodePath("d")
+	assertEqual(t, ok, false)
+}
+
+func TestInputPane(t *testing.T) {
+	var v any
+	must(0, json.Unmarshal([]byte(sampleJSON), &v))
+	p := newInputPane(v, false)
+	assertEqual(t, p.title(), "input")
+
+	find := func(path ...any) int {
+		t.Helper()
+		line, ok := p.find(path)
+		assertEqual(t, ok, true)
+		return line
+	}
+	assertEqual(t, find("d", 2), 6)
+	assertEqual(t, find("g", "x", "y"), 10)
+	assertEqual(t, find("x"), 0)
+
+	p.cycle(1)
+	assertEqual(t, find("g", "h"), 11)
+}
+
+func TestQueryPath(t *testing.T) {
+	path := func(code string) string {
+		t.Helper()
+		path, ok := data{code: code}.queryPath(context.Background())
+		if !ok {
+			return "none"
+		}
+		return pathString(path)
+	}
+	assertEqual(t, path(".d[2]"), ".d[2]")
+	assertEqual(t, path(".g | .h"), ".g.h")
+	assertEqual(t, path(".d[] | select(. == null)"), ".d[3]")
+	assertEqual(t, path(""), ".")
+	assertEqual(t, path(".a + 1"), "none")
+}
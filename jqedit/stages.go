@@ -0,0 +1,120 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// stagePrefix joins stages into a query whose outputs are the inputs of the stage after them.
+// Each stage is grouped, so that the pipes between them bind last. Blank stages are left out.
+func stagePrefix(stages []string) string {
+	var rt []string
+	for _, s := range stages {
+		if strings.TrimSpace(s) != "" {
+			rt = append(rt, "(\n"+s+"\n)")
+		}
+	}
+	return strings.Join(rt, " | ")
+}
+
+// pipeline is the query that d runs: its code, with the earlier stages piped into it.
+func (d data) pipeline() string {
+	switch {
+	case d.prefix == "":
+		return d.code
+	case strings.TrimSpace(d.code) == "":
+		return d.prefix
+	}
+	return d.prefix + " | (\n" + d.code + "\n)"
+}
+
+// historyEntry is how d is saved in the history: its code, with the stages piped into it.
+func (d data) historyEntry(t time.Time) historyEntry {
+	e := historyEntry{Time: t, Query: strings.TrimSpace(d.code), Input: d.inputSource()}
+	if d.stages != nil {
+		for _, s := range *d.stages {
+			if s := strings.TrimSpace(s); s != "" {
+				e.Stages = append(e.Stages, s)
+			}
+		}
+	}
+	if e.Query == "" && len(e.Stages) > 0 {
+		e.Query, e.Stages = e.Stages[len(e.Stages)-1], e.Stages[:len(e.Stages)-1]
+	}
+	return e
+}
+
+// stageLabel names a stage in the tab bar by the start of its query.
+func stageLabel(i int, code string, width int) string {
+	code = strings.Join(strings.Fields(code), " ")
+	return cropLine(fmt.Sprintf("%d %s", i+1, cmp.Or(code, ".")), 0, width)
+}
+
+// stagesView shows a tab for each stage, if there is more than one.
+func (m model) stagesView() string {
+	if len(m.stages) < 2 {
+		return ""
+	}
+	width := max(m.width/len(m.stages)-1, 4)
+	var tabs []string
+	for i, code := range m.stages {
+		if i == m.stage {
+			code = m.textarea.Value()
+		}
+		style := subtleStyle
+		if i == m.stage {
+			style = selectedStyle
+		}
+		tabs = append(tabs, style.Render(stageLabel(i, code, width)))
+	}
+	return strings.Join(tabs, " ")
+}
+
+// setStage edits stage i, which takes the outputs of the stages before it as its input.
+func (m *model) setStage(i int) tea.Cmd {
+	m.stages[m.stage] = m.textarea.Value()
+	return m.showStage(i)
+}
+
+func (m *model) showStage(i int) tea.Cmd {
+	m.stage = i
+	earlier := slices.Clone(m.stages[:i])
+	m.d.prefix, m.d.stages = stagePrefix(earlier), &earlier
+	m.complete, m.find = nil, nil
+	m.setCode(m.stages[i])
+	m.layout()
+	return m.reloadInput()
+}
+
+// addStage inserts a stage after the current one, taking its outputs.
+func (m *model) addStage() tea.Cmd {
+	m.stages[m.stage] = m.textarea.Value()
+	m.stages = slices.Insert(m.stages, m.stage+1, "")
+	return m.setStage(m.stage + 1)
+}
+
+// stageEntry is the query up to the current stage, as the history holds it.
+func (m model) stageEntry() historyEntry {
+	return historyEntry{Query: m.textarea.Value(), Stages: slices.Clone(m.stages[:m.stage])}
+}
+
+// recall replaces the stages up to the current one with those of e, such as from the history.
+// The stages after the current one are kept.
+func (m *model) recall(e historyEntry) tea.Cmd {
+	m.stages = slices.Concat(e.Stages, []string{e.Query}, m.stages[m.stage+1:])
+	return m.showStage(len(e.Stages))
+}
+
+// closeStage removes the current stage, keeping at least one.
+func (m *model) closeStage() tea.Cmd {
+	if len(m.stages) < 2 {
+		return nil
+	}
+	m.stages = slices.Delete(m.stages, m.stage, m.stage+1)
+	return m.showStage(max(m.stage-1, 0))
+}
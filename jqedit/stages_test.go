@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPipeline(t *testing.T) {
+	assertEqual(t, stagePrefix(nil), "")
+	assertEqual(t, stagePrefix([]string{".a", " ", ".b # c"}), "(\n.a\n) | (\n.b # c\n)")
+
+	assertEqual(t, data{code: ".a"}.pipeline(), ".a")
+	assertEqual(t, data{code: " ", prefix: "(\n.a\n)"}.pipeline(), "(\n.a\n)")
+	assertEqual(t, data{code: ".b", prefix: "(\n.a\n)"}.pipeline(), "(\n.a\n) | (\n.b\n)")
+
+	d := data{code: ".[] | . # last", prefix: stagePrefix([]string{".d, .g # first", "length"})}
+	assertEqual(t, d.format(), "jqx '(.d, .g) | (length) | (.[] | .)'")
+
+	query := func(d data) string {
+		t.Helper()
+		d.compact = true
+		rt, err := d.query(context.Background())
+		if err != nil {
+			return "error"
+		}
+		return rt
+	}
+	assertEqual(t, query(data{code: "length", prefix: stagePrefix([]string{".d, .g"})}), "5\n2\n")
+	assertEqual(t, query(data{code: "", prefix: stagePrefix([]string{".g", ".h"})}), "i\n")
+	assertEqual(t, query(data{code: ". as $x | $x", prefix: stagePrefix([]string{".a, .b as $y | $y"})}), "5\nc\n")
+
+	v, err := data{prefix: stagePrefix([]string{".g"})}.inputValue(context.Background())
+	assertEqual(t, err, nil)
+	assertEqual(t, len(v.(map[string]any)), 2)
+	path, ok := data{code: ".h", prefix: stagePrefix([]string{".g"})}.queryPath(context.Background())
+	assertEqual(t, ok, true)
+	assertEqual(t, pathString(path), ".h")
+}
+
+func TestRecallStages(t *testing.T) {
+	defer func(f func(data)) { setQuery = f }(setQuery)
+	setQuery = func(data) {}
+
+	m := newModel(data{})
+	m.stages = []string{".g", ".h", "length"}
+	m.showStage(1)
+	e := m.d.historyEntry(time.Time{})
+	assertEqual(t, e.Query, ".h")
+	assertEqual(t, e.text(), ".g | .h")
+
+	// Recalling in stage 2 replaces the stages up to it, without running any twice
+	m.recall(historyEntry{Query: ".b", Stages: []string{"."}})
+	assertEqual(t, m.stage, 1)
+	assertEqual(t, strings.Join(m.stages, " ; "), ". ; .b ; length")
+	assertEqual(t, m.d.pipeline(), "(\n.\n) | (\n.b\n)")
+	m.recall(historyEntry{Query: ".a"})
+	assertEqual(t, m.stage, 0)
+	assertEqual(t, m.d.pipeline(), ".a")
+	assertEqual(t, m.textarea.Value(), ".a")
+
+	// Blank stages are left out, and a blank last stage gives way to the one before it
+	m.stages = []string{".g", " ", ""}
+	m.showStage(2)
+	assertEqual(t, m.d.historyEntry(time.Time{}).text(), ".g")
+}
+
+func TestStageInput(t *testing.T) {
+	defer func(f func(data)) { setQuery = f }(setQuery)
+	setQuery = func(data) {}
+
+	m := newModel(data{})
+	m.tree = newTree(nil)
+	m.stages = []string{".g", ""}
+	msg := m.showStage(1)().(inputValueMsg)
+	assertEqual(t, msg.err, nil)
+	m2, _ := m.Update(msg)
+	assertEqual(t, len(m2.(model).tree.root.visible()), 3)
+
+	// A stage that never ends is given up on, rather than hanging
+	m.stages = []string{"repeat(.)", ""}
+	cmd := m.showStage(1)
+	start := time.Now()
+	msg = cmd().(inputValueMsg)
+	assertEqual(t, msg.err != nil, true)
+	assertEqual(t, time.Since(start) < 5*time.Second, true)
+}
+
+func TestStageLabel(t *testing.T) {
+	assertEqual(t, stageLabel(0, "", 10), "1 .")
+	assertEqual(t, stageLabel(1, ".a |\n  .b", 10), "2 .a | .b")
+	assertEqual(t, stageLabel(2, "select(.a == 1)", 10), "3 selec...")
+}
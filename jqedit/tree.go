@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+var identRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// pathString formats path, made of object keys and array indices, as a jq path such as .d[2].
+func pathString(path []any) string {
+	var rt strings.Builder
+	for _, k := range path {
+		switch k := k.(type) {
+		case int:
+			fmt.Fprintf(&rt, "[%d]", k)
+		case string:
+			if identRe.MatchString(k) {
+				rt.WriteString("." + k)
+				break
+			}
+			if rt.Len() == 0 {
+				rt.WriteString(".")
+			}
+			rt.WriteString("[" + string(must(json.Marshal(k))) + "]")
+		}
+	}
+	if rt.Len() == 0 || rt.String()[0] == '[' {
+		return "." + rt.String()
+	}
+	return rt.String()
+}
+
+// treeNode is a value in the path explorer, whose children are created when it is first opened.
+type treeNode struct {
+	key    any // string or int; nil for the root
+	value  any
+	parent *treeNode
+
+	open     bool
+	children []*treeNode
+}
+
+func (n *treeNode) depth() (rt int) {
+	for n := n.parent; n != nil; n = n.parent {
+		rt++
+	}
+	return
+}
+
+func (n *treeNode) path() []any {
+	if n.parent == nil {
+		return nil
+	}
+	return append(n.parent.path(), n.key)
+}
+
+func (n *treeNode) expandable() bool {
+	switch v := n.value.(type) {
+	case map[string]any:
+		return len(v) > 0
+	case []any:
+		return len(v) > 0
+	}
+	return false
+}
+
+func (n *treeNode) setOpen(open bool) {
+	n.open = open && n.expandable()
+	if !n.open || n.children != nil {
+		return
+	}
+
+	switch v := n.value.(type) {
+	case map[string]any:
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			n.children = append(n.children, &treeNode{key: k, value: v[k], parent: n})
+		}
+	case []any:
+		for i, e := range v {
+			n.children = append(n.children, &treeNode{key: i, value: e, parent: n})
+		}
+	}
+}
+
+// visible lists n and the descendants shown under it, in order.
+func (n *treeNode) visible() []*treeNode {
+	rt := []*treeNode{n}
+	if n.open {
+		for _, c := range n.children {
+			rt = append(rt, c.visible()...)
+		}
+	}
+	return rt
+}
+
+func (n *treeNode) label() string {
+	var rt string
+	switch {
+	case n.open:
+		rt = "- "
+	case n.expandable():
+		rt = "+ "
+	default:
+		rt = "  "
+	}
+
+	switch k := n.key.(type) {
+	case nil:
+		rt += ". "
+	case int:
+		rt += fmt.Sprintf("[%d] ", k)
+	case string:
+		rt += k + ": "
+	}
+
+	switch v := n.value.(type) {
+	case map[string]any:
+		rt += fmt.Sprintf("{%d}", len(v))
+	case []any:
+		rt += fmt.Sprintf("[%d]", len(v))
+	default:
+		rt += string(must(json.Marshal(v)))
+	}
+	return rt
+}
+
+// tree is the path explorer pane.
+type tree struct {
+	root   *treeNode
+	cursor int
+	offset int
+}
+
+func newTree(v any) *tree {
+	root := &treeNode{value: v}
+	root.setOpen(true)
+	return &tree{root: root}
+}
+
+func (t *tree) selected() *treeNode {
+	return t.root.visible()[t.cursor]
+}
+
+func (t *tree) move(delta int) {
+	t.cursor = min(max(t.cursor+delta, 0), len(t.root.visible())-1)
+}
+
+// expand opens the selected node, or moves into it if it is already open.
+func (t *tree) expand() {
+	n := t.selected()
+	if n.open {
+		t.move(1)
+		return
+	}
+	n.setOpen(true)
+}
+
+// collapse closes the selected node, or moves to its parent if it is already closed.
+func (t *tree) collapse() {
+	n := t.selected()
+	if n.open {
+		n.setOpen(false)
+		return
+	}
+	if n.parent != nil {
+		t.cursor = slices.Index(t.root.visible(), n.parent)
+	}
+}
+
+func (t *tree) view(width, height int, focused bool) string {
+	nodes := t.root.visible()
+	t.offset = min(max(t.offset, t.cursor-height+1), t.cursor)
+
+	var lines []string
+	for i, n := range nodes[t.offset:min(t.offset+height, len(nodes))] {
+		line := strings.Repeat("  ", n.depth()) + n.label()
+		line = truncLines(line, width)
+		line += strings.Repeat(" ", max(width-lipgloss.Width(line), 0))
+		if t.offset+i == t.cursor && focused {
+			line = selectedStyle.Render(line)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPathString(t *testing.T) {
+	assertEqual(t, pathString(nil), ".")
+	assertEqual(t, pathString([]any{"d", 2}), ".d[2]")
+	assertEqual(t, pathString([]any{2, "a"}), ".[2].a")
+	assertEqual(t, pathString([]any{"a b", "c"}), `.["a b"].c`)
+	assertEqual(t, pathString([]any{"g", `"x"`}), `.g["\"x\""]`)
+}
+
+func TestTree(t *testing.T) {
+	var v any
+	must(0, json.Unmarshal([]byte(sampleJSON), &v))
+	tr := newTree(v)
+
+	labels := func() string {
+		var rt []string
+		for _, n := range tr.root.visible() {
+			rt = append(rt, strings.TrimSpace(n.label()))
+		}
+		return strings.Join(rt, " | ")
+	}
+	assertEqual(t, labels(), `- . {5} | a: 5 | b: "c" | + d: [5] | + g: {2} | l: null`)
+
+	tr.move(3)
+	tr.expand()
+	assertEqual(t, labels(), `- . {5} | a: 5 | b: "c" | - d: [5] | [0] "e" | [1] true | [2] -11.5 | [3] null | [4] "f" | + g: {2} | l: null`)
+	tr.expand()
+	tr.move(2)
+	assertEqual(t, pathString(tr.selected().path()), ".d[2]")
+
+	tr.collapse()
+	assertEqual(t, pathString(tr.selected().path()), ".d")
+	tr.collapse()
+	assertEqual(t, labels(), `- . {5} | a: 5 | b: "c" | + d: [5] | + g: {2} | l: null`)
+
+	tr.move(100)
+	assertEqual(t, pathString(tr.selected().path()), ".l")
+	tr.move(-100)
+	assertEqual(t, pathString(tr.selected().path()), ".")
+
+	view := tr.view(10, 3, false)
+	assertEqual(t, view, "- . {5}   \n    a: 5  \n    b: \"c\"")
+}
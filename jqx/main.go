@@ -1,13 +1,17 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 
 	"github.com/alecthomas/chroma/v2/quick"
+	"github.com/itchyny/gojq"
 	"github.com/myaaaaaaaaa/go-jqx"
 )
 
@@ -19,11 +23,29 @@ func isTerminal(f fs.File) bool {
 	return stat.Mode()&fs.ModeCharDevice != 0
 }
 
-func try(err error) {
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(5)
+// exitCode prints err, if any, and returns the status to exit with.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	code := 2
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	}
+	var halt *gojq.HaltError
+	if errors.As(err, &halt) {
+		if s, ok := halt.Value().(string); ok {
+			// As in jq, strings given to halt_error are printed as they are
+			fmt.Fprint(os.Stderr, s)
+			return code
+		}
 	}
+	if msg := err.Error(); msg != "" {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+	return code
 }
 func must[T any](val T, err error) T {
 	if err != nil {
@@ -46,18 +68,27 @@ func (w SigPipeWriter) Write(b []byte) (int, error) {
 }
 
 func main() {
+	os.Exit(run())
+}
+
+// run runs jqx, returning its exit status once the pager, if any, has exited.
+func run() int {
 	prog := jqx.Program{
 		Args: os.Args[1:],
 
 		Open: func(f string) (fs.File, error) { return os.Open(f) },
 		Find: os.DirFS,
 
-		Stdin:   os.Stdin,
-		Println: func(s string) { fmt.Println(s) },
+		Stdin:    os.Stdin,
+		Print:    func(s string) { fmt.Print(s) },
+		Eprintln: func(s string) { fmt.Fprintln(os.Stderr, s) },
 
 		StdinIsTerminal:  isTerminal(os.Stdin),
 		StdoutIsTerminal: isTerminal(os.Stdout),
 	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		prog.Config = os.DirFS(filepath.Join(dir, "jqx"))
+	}
 
 	if prog.StdinIsTerminal && prog.StdoutIsTerminal && len(prog.Args) == 0 {
 		prog.Args = []string{"-h"}
@@ -72,15 +103,15 @@ func main() {
 		if err := cmd.Start(); err != nil {
 			defer fmt.Fprintf(os.Stderr, "warning: failed to pipe output to less: %v\n", err)
 		} else {
-			prog.Println = func(s string) {
-				if s != "" {
-					switch s[:1] + s[len(s)-1:] {
+			prog.Print = func(s string) {
+				if v := strings.TrimSuffix(s, "\n"); v != "" {
+					switch v[:1] + v[len(v)-1:] {
 					case `{}`, `[]`, `""`:
-						must(0, quick.Highlight(pipe, s+"\n", "json", "terminal256", "github"))
+						must(0, quick.Highlight(pipe, s, "json", "terminal256", "github"))
 						return
 					}
 				}
-				fmt.Fprintln(pipe, s)
+				fmt.Fprint(pipe, s)
 			}
 			defer cmd.Wait()
 			defer pipe.Close()
@@ -88,6 +119,10 @@ func main() {
 	}
 
 	fsys, err := prog.Main()
-	try(err)
-	try(os.CopyFS(".", fsys))
+	if fsys != nil {
+		if err := os.CopyFS(".", fsys); err != nil {
+			return exitCode(err)
+		}
+	}
+	return exitCode(err)
 }
@@ -0,0 +1,167 @@
+// Package jqx extends gojq with builtins for hashing, shuffling,
+// HTML and XML, and snapshots of values to files.
+//
+// Queries are compiled with [Compile] and run with [Query.Run]:
+//
+//	query, err := jqx.Compile(`.[] | sha256`, jqx.WithVariables(vars))
+//	if err != nil {
+//		return err
+//	}
+//	for v, err := range query.Run(ctx, input) {
+//		...
+//	}
+package jqx
+
+import (
+	"context"
+	"errors"
+	"io"
+	"iter"
+	"maps"
+
+	"github.com/itchyny/gojq"
+)
+
+// Query is a compiled query. It can be run any number of times.
+type Query struct {
+	state  State
+	run    runner
+	format format
+	raw    bool
+}
+
+// Option configures a [Query] in [Compile].
+type Option func(*Query)
+
+// WithVariables makes each of vars available as $name, and all of them as $vars.
+func WithVariables(vars map[string]any) Option {
+	return func(q *Query) {
+		if q.state.Globals == nil {
+			q.state.Globals = map[string]any{}
+		}
+		maps.Copy(q.state.Globals, vars)
+	}
+}
+
+// WithFunction adds a Go function, as with [State.Define].
+func WithFunction(name string, minArity, maxArity int, f func(any, []any) any) Option {
+	return func(q *Query) { q.state.Define(name, minArity, maxArity, f) }
+}
+
+// WithIterFunction adds a Go function that yields any number of values,
+// as with [State.DefineIter].
+func WithIterFunction(name string, minArity, maxArity int, f func(any, []any) gojq.Iter) Option {
+	return func(q *Query) { q.state.DefineIter(name, minArity, maxArity, f) }
+}
+
+// WithModulePaths sets the directories searched by import and include.
+func WithModulePaths(paths ...string) Option {
+	return func(q *Query) { q.state.ModulePaths = paths }
+}
+
+// WithLimits bounds the resources used by each run,
+// and the size of each reader given to [Query.Decode].
+func WithLimits(limits Limits) Option {
+	return func(q *Query) { q.state.Limits = limits }
+}
+
+// WithRawInput makes [Query.Decode] yield lines as strings, like jqx -r.
+func WithRawInput() Option {
+	return func(q *Query) { q.raw = true }
+}
+
+// WithTabIndent makes [Query.Marshal] indent with tabs, like jqx -t.
+func WithTabIndent() Option {
+	return func(q *Query) { q.format.indent = "\t" }
+}
+
+// WithJSONStrings makes [Query.Marshal] quote strings, like jqx -j.
+// By default, strings are written as they are.
+func WithJSONStrings() Option {
+	return func(q *Query) { q.format.str = false }
+}
+
+// WithPreservedOrder makes [Query.Marshal] write object keys in the order
+// [Query.Decode] read them, like jqx --preserve-order. By default, keys are sorted.
+// The order of each decoded object is kept for as long as the Query is.
+func WithPreservedOrder() Option {
+	return func(q *Query) { q.format.order = &keyOrder{} }
+}
+
+// Compile parses and compiles query, returning a *[QueryParseError] if it is invalid.
+func Compile(query string, opts ...Option) (*Query, error) {
+	q := &Query{format: format{str: true}}
+	for _, opt := range opts {
+		opt(q)
+	}
+
+	run, err := q.state.compile(query)
+	if err != nil {
+		return nil, err
+	}
+	q.run = run
+	return q, nil
+}
+
+// Run yields the results of the query on input,
+// stopping after the first error, which is a *[RuntimeError].
+//
+// input must consist of values like those yielded by [Query.Decode].
+func (q *Query) Run(ctx context.Context, input any) iter.Seq2[any, error] {
+	return q.RunWithVariables(ctx, input, q.state.Globals)
+}
+
+// RunWithVariables is like [Query.Run], with other values for the variables
+// given to [WithVariables]. Variables missing from vars are null.
+func (q *Query) RunWithVariables(ctx context.Context, input any, vars map[string]any) iter.Seq2[any, error] {
+	return func(yield func(any, error) bool) {
+		for v := range q.state.saving(q.run(ctx, input, vars)) {
+			if err, ok := v.(*RuntimeError); ok {
+				yield(nil, err)
+				return
+			}
+			if !yield(v, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Files returns the values saved by snapshot, keyed by filename.
+func (q *Query) Files() map[string]any {
+	return q.state.Files
+}
+
+// Decode yields the inputs in r, stopping after the first error.
+// Invalid JSON is reported as a *[DecodeError].
+func (q *Query) Decode(r io.Reader, name string) iter.Seq2[any, error] {
+	return func(yield func(any, error) bool) {
+		r := limitInput(r, q.state.Limits.InputBytes)
+		input := decoder(r, name, nil, q.format.order)
+		if q.raw {
+			input = lines(r, name)
+		}
+
+		var err error
+		func() {
+			defer catch[failError](&err)
+			for v := range input {
+				if !yield(v, nil) {
+					return
+				}
+			}
+		}()
+
+		if err != nil {
+			if cause := errors.Unwrap(err); cause != nil {
+				err = cause
+			}
+			yield(nil, err)
+		}
+	}
+}
+
+// Marshal encodes an output of the query.
+func (q *Query) Marshal(v any) ([]byte, error) {
+	return q.format.marshal(v)
+}
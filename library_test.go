@@ -0,0 +1,117 @@
+package jqx
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLibrary(t *testing.T) {
+	query, err := Compile(`$x + ., mul2`,
+		WithVariables(map[string]any{"x": 10}),
+		WithFunction("mul2", 0, 0, func(v any, _ []any) any { return v.(int) * 2 }),
+		WithTabIndent(),
+	)
+	assertEqual(t, err, nil)
+
+	var got []string
+	for input, err := range query.Decode(strings.NewReader("1 2"), "in") {
+		assertEqual(t, err, nil)
+		for v, err := range query.Run(context.Background(), input) {
+			assertEqual(t, err, nil)
+			got = append(got, string(must(query.Marshal(v))))
+		}
+	}
+	assertString(t, got, `[11 2 12 4]`)
+
+	_, err = Compile(`mul2`)
+	var parseErr *QueryParseError
+	assertEqual(t, errors.As(err, &parseErr), true)
+}
+func TestLibraryErrors(t *testing.T) {
+	query := must(Compile(`.[]`))
+
+	var got []any
+	for v, err := range query.Decode(strings.NewReader("[1] 2 [3]"), "in") {
+		for v, err := range query.Run(context.Background(), v) {
+			if err != nil {
+				var runtimeErr *RuntimeError
+				assertEqual(t, errors.As(err, &runtimeErr), true)
+				got = append(got, "error")
+				break
+			}
+			got = append(got, v)
+		}
+		assertEqual(t, err, nil)
+	}
+	assertString(t, got, `[1 error 3]`)
+
+	var decodeErr *DecodeError
+	for _, err := range query.Decode(strings.NewReader("[1] [}"), "in") {
+		if err != nil {
+			assertEqual(t, errors.As(err, &decodeErr), true)
+		}
+	}
+	assertEqual(t, decodeErr.Column, 6)
+
+	for _, raw := range []bool{false, true} {
+		opts := []Option{WithLimits(Limits{InputBytes: 4})}
+		if raw {
+			opts = append(opts, WithRawInput())
+		}
+		query := must(Compile(`.`, opts...))
+		var limitErr *LimitError
+		for _, err := range query.Decode(strings.NewReader(`"a somewhat long string"`), "in") {
+			if err != nil {
+				assertEqual(t, errors.As(err, &limitErr), true)
+			}
+		}
+		assertEqual(t, limitErr.Max, 4)
+	}
+}
+func TestLibraryFormat(t *testing.T) {
+	marshal := func(v any, opts ...Option) string {
+		return string(must(must(Compile(".", opts...)).Marshal(v)))
+	}
+	assertEqual(t, marshal("a"), `a`)
+	assertEqual(t, marshal("a", WithJSONStrings()), `"a"`)
+	assertEqual(t, marshal([]any{1}), `[1]`)
+	assertEqual(t, marshal([]any{1}, WithTabIndent()), "[\n\t1\n]")
+
+	query := must(Compile(".", WithRawInput()))
+	var got []any
+	for v, err := range query.Decode(strings.NewReader("a\n[}"), "in") {
+		assertEqual(t, err, nil)
+		got = append(got, v)
+	}
+	assertString(t, got, `[a [}]`)
+
+	query = must(Compile(".", WithPreservedOrder()))
+	for v, err := range query.Decode(strings.NewReader(`{"b":1,"a":2}`), "in") {
+		assertEqual(t, err, nil)
+		assertEqual(t, string(must(query.Marshal(v))), `{"b":1,"a":2}`)
+	}
+
+	query = must(Compile(`snapshot("f"; .)`))
+	for range query.Run(context.Background(), 5) {
+	}
+	assertString(t, query.Files(), `map[f:5]`)
+}
+func TestRunWithVariables(t *testing.T) {
+	query := must(Compile(`[$a, $b]`, WithVariables(map[string]any{"a": 1, "b": 2})))
+	run := func(vars map[string]any) (rt []any) {
+		for v, err := range query.RunWithVariables(context.Background(), nil, vars) {
+			assertEqual(t, err, nil)
+			rt = append(rt, v)
+		}
+		return
+	}
+
+	assertString(t, run(map[string]any{"a": 3, "b": 4}), `[[3 4]]`)
+	assertString(t, run(map[string]any{"a": 5}), `[[5 <nil>]]`)
+	assertString(t, run(map[string]any{"c": 5}), `[[<nil> <nil>]]`)
+	for v := range query.Run(context.Background(), nil) {
+		assertString(t, v, `[1 2]`)
+	}
+}
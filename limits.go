@@ -0,0 +1,76 @@
+package jqx
+
+import (
+	"context"
+	"io"
+)
+
+// Limits bounds the resources a query may use. Zero fields are unlimited.
+type Limits struct {
+	// Outputs bounds the number of values yielded for each input.
+	Outputs int
+	// OutputBytes bounds the total JSON size of values yielded for each input.
+	OutputBytes int
+	// Steps bounds the evaluation steps taken for each input,
+	// which also bounds recursion.
+	Steps int
+
+	// InputBytes bounds the size of each input read by [Program],
+	// whether stdin or a file, or by [Query.Decode].
+	InputBytes int64
+}
+
+var closed = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// stepContext counts evaluation steps.
+// gojq polls Done before every instruction it executes.
+type stepContext struct {
+	context.Context
+	steps, max int
+}
+
+func (c *stepContext) Done() <-chan struct{} {
+	c.steps++
+	if c.steps > c.max {
+		return closed
+	}
+	return c.Context.Done()
+}
+func (c *stepContext) Err() error {
+	if c.steps > c.max {
+		return &LimitError{"steps", int64(c.max)}
+	}
+	return c.Context.Err()
+}
+
+type limitReader struct {
+	r        io.Reader
+	n, limit int64
+}
+
+// limitInput fails reads from r once more than limit bytes have been read.
+func limitInput(r io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return r
+	}
+	return &limitReader{r, 0, limit}
+}
+
+// Read reads at most one byte past the limit, to find out whether r goes past it.
+func (l *limitReader) Read(b []byte) (int, error) {
+	if l.n > l.limit {
+		return 0, &LimitError{"input bytes", l.limit}
+	}
+
+	b = b[:min(int64(len(b)), l.limit-l.n+1)]
+	n, err := l.r.Read(b)
+	l.n += int64(n)
+	if l.n > l.limit {
+		return n - 1, &LimitError{"input bytes", l.limit}
+	}
+	return n, err
+}
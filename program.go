@@ -2,7 +2,9 @@ package jqx
 
 import (
 	"bufio"
-	"encoding/json"
+	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -10,9 +12,16 @@ import (
 	"iter"
 	"maps"
 	"os"
+	"runtime"
 	"runtime/debug"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/itchyny/gojq"
 )
 
 func lines(r io.Reader, name string) iter.Seq[any] {
@@ -28,32 +37,40 @@ func lines(r io.Reader, name string) iter.Seq[any] {
 	}
 }
 
-func decoder(r io.Reader, name string) iter.Seq[any] {
-	return func(yield func(any) bool) {
-		decoder := json.NewDecoder(r)
-		for {
-			var v any
-			err := decoder.Decode(&v)
-			if err == io.EOF {
-				return
-			}
-			failif(err, "decoding %s", name)
-			if !yield(v) {
-				break
-			}
-		}
-	}
-}
-
 type Program struct {
 	Args []string
 
+	// Context, if set, stops the program when it is done.
+	Context context.Context
+	Limits  Limits
+
+	// Setup, if set, can customize the State before the query is compiled,
+	// such as to define additional functions.
+	Setup func(*State)
+
+	// Cache, if set, is used to skip work done by previous runs.
+	// It is not used along with Setup.
+	Cache *Cache
+
+	// Open reads input files, and the query file given with -f.
+	// Input files are loaded several at once, so it must be safe for concurrent use.
 	Open func(string) (fs.File, error)
 	Find func(string) fs.FS
 
+	// Config holds user *.jq files whose definitions are available to every query.
+	Config fs.FS
+
 	Stdin   io.Reader
 	Println func(string)
 
+	// Print, if set, is used instead of Println and receives each output
+	// with its separator, which Println cannot receive for options such as
+	// --join-output and --raw-output0.
+	Print func(string)
+
+	// Eprintln, if set, receives diagnostics such as errors skipped with -k.
+	Eprintln func(string)
+
 	StdinIsTerminal  bool
 	StdoutIsTerminal bool
 }
@@ -63,10 +80,27 @@ type flags struct {
 	dry     bool
 	tab     bool
 	rawIn   bool
+	slurp   bool
+	null    bool
 	jsonOut bool
 	env     bool
+	status  bool
+	keep    bool
+	ordered bool
 
-	find string
+	indent   int
+	sortKeys bool
+	ascii    bool
+	join     bool
+	raw0     bool
+	seq      bool
+
+	timeout  time.Duration
+	parallel int
+
+	find        string
+	script      string
+	modulePaths []string
 }
 
 func (f *flags) populate(args []string) {
@@ -74,10 +108,38 @@ func (f *flags) populate(args []string) {
 	fset.BoolVar(&f.dry, "dry-run", false, `don't persist snapshots`)
 	fset.BoolVar(&f.tab, "t", false, `(tab) always indent output`)
 	fset.BoolVar(&f.rawIn, "r", false, `(raw) inputs are newline-separated strings`)
+	fset.BoolVar(&f.slurp, "s", false, `(slurp) read all inputs into one array`)
+	fset.BoolVar(&f.null, "n", false, `(null) run the query once with null as its input, without reading stdin`)
 	fset.BoolVar(&f.jsonOut, "j", false, `(json) always output json (strings are unwrapped by default)`)
 	fset.BoolVar(&f.env, "e", false, `(env) enable $env`)
+	fset.BoolVar(&f.keep, "k", false, `(keep going) report malformed inputs and query errors, then continue`)
+	fset.BoolVar(&f.ordered, "preserve-order", false, `write object keys in the order they were read, instead of sorted`)
+	fset.BoolVar(&f.status, "exit-status", false, `set exit status from the last output, like jq -e`)
+
+	f.indent = -1
+	fset.Func("indent", `indent output with N spaces, up to 7 (0 for compact output)`, func(s string) error {
+		n, err := strconv.Atoi(s)
+		if err == nil && (n < 0 || n > 7) {
+			err = errors.New("must be between 0 and 7")
+		}
+		f.indent = n
+		return err
+	})
+	fset.BoolVar(&f.sortKeys, "sort-keys", false, `sort object keys, even with --preserve-order`)
+	fset.BoolVar(&f.ascii, "ascii-output", false, `escape characters outside of ASCII`)
+	fset.BoolVar(&f.join, "join-output", false, `don't write a newline after each output`)
+	fset.BoolVar(&f.raw0, "raw-output0", false, `write a NUL after each output instead of a newline`)
+	fset.BoolVar(&f.seq, "seq", false, `write an ASCII RS before each output, as in RFC 7464`)
+
+	fset.IntVar(&f.parallel, "P", 1, `(parallel) evaluate up to N inputs at once, keeping outputs in order`)
+	fset.DurationVar(&f.timeout, "timeout", 0, `stop the query after this long (e.g. 10s)`)
 
 	fset.StringVar(&f.find, "find", "", `enable $find`)
+	fset.StringVar(&f.script, "f", "", `(file) read query from file; all arguments are input files`)
+	fset.Func("L", `(library) add directory to module search path (default ~/.jq)`, func(s string) error {
+		f.modulePaths = append(f.modulePaths, s)
+		return nil
+	})
 
 	usage := fset.Usage
 	fset.Usage = func() {
@@ -94,6 +156,9 @@ func (f *flags) populate(args []string) {
 
 	fset.Parse(args)
 	f.args = fset.Args()
+	if f.sortKeys {
+		f.ordered = false
+	}
 }
 
 func (p Program) Main() (fsys fs.FS, rtErr error) {
@@ -102,52 +167,165 @@ func (p Program) Main() (fsys fs.FS, rtErr error) {
 	var f flags
 	f.populate(p.Args)
 
+	ctx := p.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if f.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, f.timeout)
+		defer cancel()
+	}
+
 	script, filenames := ".", f.args
-	if len(filenames) > 0 {
+	if f.script != "" {
+		file, err := p.Open(f.script)
+		failif(err, "loading query")
+		b, err := io.ReadAll(file)
+		file.Close()
+		failif(err, "reading query")
+		script = string(b)
+	} else if len(filenames) > 0 {
 		script, filenames = filenames[0], filenames[1:]
 	}
 
-	files := map[string]any{}
-	slices.Values(filenames)(func(filename string) bool {
+	var skipped []failError
+	var skip func(error)
+	if f.keep {
+		eprintln := p.Eprintln
+		if eprintln == nil {
+			eprintln = func(string) {}
+		}
+		var mu sync.Mutex
+		skip = func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			skipped = append(skipped, err.(failError))
+			eprintln(err.Error())
+		}
+	}
+
+	cache := p.Cache
+	if p.Setup != nil {
+		cache = nil
+	}
+
+	// Files are loaded at once, but stored and reported in order
+	type loaded struct {
+		fileData
+		errs []error
+	}
+	results := parallelMap(filenames, runtime.GOMAXPROCS(0), func(filename string) (rt loaded) {
+		var skipFile func(error)
+		if skip != nil {
+			skipFile = func(err error) { rt.errs = append(rt.errs, err) }
+		}
+
 		file, err := p.Open(filename)
 		failif(err, "loading")
 		defer file.Close()
+		r := limitInput(file, p.Limits.InputBytes)
 
-		var data any
+		rt.fileData = cache.file(filename, file, fileMode{f.rawIn, f.ordered}, func() (data fileData, reuse bool) {
+			if f.rawIn {
+				b, err := io.ReadAll(r)
+				failif(err, "reading")
+				return fileData{data: string(b)}, true
+			}
 
-		if f.rawIn {
-			b, err := io.ReadAll(file)
-			failif(err, "reading")
-			data = string(b)
-		} else {
-			v := slices.Collect(decoder(file, filename))
+			if f.ordered {
+				data.order = &keyOrder{}
+			}
+			v := slices.Collect(decoder(r, filename, skipFile, data.order))
 			if len(v) == 1 {
-				data = v[0]
+				data.data = v[0]
 			} else {
-				data = v
+				data.data = v
 			}
-		}
-
-		files[filename] = data
-
-		return true
+			return data, len(rt.errs) == 0
+		})
+		return
 	})
+	var order *keyOrder
+	if f.ordered {
+		order = &keyOrder{}
+	}
+	files := map[string]any{}
+	for i, filename := range filenames {
+		files[filename] = results[i].data
+		if order != nil {
+			order.merge(results[i].order)
+		}
+		for _, err := range results[i].errs {
+			skip(err)
+		}
+	}
 
-	input := decoder(p.Stdin, "stdin")
+	stdin := limitInput(p.Stdin, p.Limits.InputBytes)
+	input := decoder(stdin, "stdin", skip, order)
 	if f.rawIn {
-		input = lines(p.Stdin, "stdin")
+		input = lines(stdin, "stdin")
+	}
+	if f.slurp {
+		inputs := input
+		input = func(yield func(any) bool) { yield(slices.AppendSeq([]any{}, inputs)) }
 	}
 	if p.StdinIsTerminal {
 		input = func(yield func(any) bool) { yield(files) }
 	}
+	if f.null {
+		input = func(yield func(any) bool) { yield(nil) }
+	}
 
-	marshal := getMarshaler(
-		f.tab || (p.StdoutIsTerminal && !f.jsonOut),
-		!f.jsonOut,
-	)
+	// Files hold one value each, so they are formatted like outputs, without separators
+	fileFormat := format{str: !f.jsonOut, ascii: f.ascii, order: order}
+	switch {
+	case f.indent >= 0:
+		fileFormat.indent = strings.Repeat(" ", f.indent)
+	case f.tab:
+		fileFormat.indent = "\t"
+	}
+	outFormat := fileFormat
+	if f.indent < 0 && p.StdoutIsTerminal && !f.jsonOut {
+		outFormat.indent = "\t"
+	}
+	marshal := getMarshaler(outFormat)
 
-	state := State{
-		Globals: map[string]any{"files": files},
+	prefix, sep := "", "\n"
+	if f.seq {
+		prefix = "\x1e"
+	}
+	if f.join {
+		sep = ""
+	}
+	if f.raw0 {
+		sep = "\x00"
+	}
+	write := p.Print
+	if write == nil {
+		write = func(s string) { p.Println(strings.TrimSuffix(s, "\n")) }
+	}
+
+	state := &State{
+		Globals:     map[string]any{"files": files},
+		Context:     ctx,
+		Limits:      p.Limits,
+		ModulePaths: f.modulePaths,
+	}
+	if state.ModulePaths == nil {
+		state.ModulePaths = []string{"~/.jq"}
+	}
+	if p.Config != nil {
+		names, err := fs.Glob(p.Config, "*.jq")
+		failif(err, "listing config")
+		for _, name := range names {
+			b, err := fs.ReadFile(p.Config, name)
+			failif(err, "reading config")
+			defs, err := cache.parse(string(b))
+			failcode(exitCompile, err, "parsing %s", name)
+			state.Defs = append(state.Defs, defs...)
+		}
 	}
 	if f.env {
 		envVars := map[string]any{}
@@ -173,23 +351,208 @@ func (p Program) Main() (fsys fs.FS, rtErr error) {
 		failif(err, "finding subdirs")
 		state.Globals["find"] = find
 	}
-	query := state.Compile(constString(script))
-	for v := range input {
-		for v := range query(v) {
-			v := marshal(v)
-			p.Println(string(v))
+	if p.Setup != nil {
+		p.Setup(state)
+	}
+	state, query, release, err := cache.compile(state, script)
+	failcode(exitCompile, err, "parsing query")
+	defer release()
+	var last any
+	outputs := 0
+	emit := func(results iter.Seq[any]) {
+		var err error
+		func() {
+			defer catch[failError](&err)
+			for v := range state.saving(results) {
+				if err, ok := v.(*RuntimeError); ok {
+					if halt, ok := err.Err.(*gojq.HaltError); ok {
+						msg := haltMessage(halt.Value())
+						panic(haltError{failError{msg, halt.ExitCode(), halt}})
+					}
+					failcode(exitRuntime, err, "running query")
+				}
+				last = v
+				outputs++
+				v := marshal(v)
+				if f.raw0 && bytes.IndexByte(v, 0) >= 0 {
+					failcode(exitRuntime, errors.New("string contains NUL"), "writing output with --raw-output0")
+				}
+				write(prefix + string(v) + sep)
+			}
+		}()
+		if err != nil {
+			if skip == nil {
+				panic(err)
+			}
+			skip(err)
 		}
 	}
 
+	var halt error
+	func() {
+		defer catch[haltError](&halt)
+		if f.parallel > 1 {
+			for v, results := range parallel(input, query, f.parallel, cancel) {
+				failcode(exitRuntime, ctx.Err(), "running query")
+				emit(results)
+				order.forget(v)
+			}
+			return
+		}
+		for v := range input {
+			failcode(exitRuntime, ctx.Err(), "running query")
+			emit(query(v))
+			order.forget(v)
+		}
+	}()
+
 	if f.dry {
 		for _, file := range slices.Sorted(maps.Keys(state.Files)) {
-			p.Println(file)
+			write(file + "\n")
 		}
 		state.Files = nil
 	}
 
-	fsys = toFS(state.Files, getMarshaler(f.tab, !f.jsonOut))
+	fsys = toFS(state.Files, getMarshaler(fileFormat))
 	rtErr = nil
 
+	switch {
+	case halt != nil:
+		if halt.(haltError).code != 0 || halt.Error() != "" {
+			rtErr = halt
+		}
+	case len(skipped) > 0:
+		msg := "1 error skipped"
+		if len(skipped) > 1 {
+			msg = fmt.Sprintf("%d errors skipped", len(skipped))
+		}
+		rtErr = failError{msg, skipped[len(skipped)-1].code, nil}
+	case !f.status:
+	case outputs == 0:
+		rtErr = failError{"", exitEmpty, nil}
+	case last == nil || last == false:
+		rtErr = failError{"", exitFalsy, nil}
+	}
+
 	return
 }
+
+// parallel runs query on up to n inputs at once, yielding each input with its results, in order.
+// If iteration stops early, cancel is called to stop queries still running.
+func parallel(input iter.Seq[any], query FanOut, n int, cancel func()) iter.Seq2[any, iter.Seq[any]] {
+	type result struct {
+		input    any
+		values   []any
+		panicked any
+	}
+
+	return func(yield func(any, iter.Seq[any]) bool) {
+		var mu sync.Mutex
+		var running sync.WaitGroup
+		done := make(chan struct{})
+		start := func(f func()) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			select {
+			case <-done:
+				return false
+			default:
+				running.Go(f)
+				return true
+			}
+		}
+		defer func() {
+			mu.Lock()
+			close(done)
+			mu.Unlock()
+			cancel()
+			running.Wait()
+		}()
+
+		queue := make(chan chan result, n-1)
+		go func() {
+			defer close(queue)
+			defer func() {
+				// Failures while reading inputs are reported in order
+				if r := recover(); r != nil {
+					ch := make(chan result, 1)
+					ch <- result{panicked: r}
+					select {
+					case queue <- ch:
+					case <-done:
+					}
+				}
+			}()
+
+			for v := range input {
+				ch := make(chan result, 1)
+				select {
+				case queue <- ch:
+				case <-done:
+					return
+				}
+				if !start(func() { ch <- result{input: v, values: slices.Collect(query(v))} }) {
+					return
+				}
+			}
+		}()
+
+		for ch := range queue {
+			r := <-ch
+			if r.panicked != nil {
+				panic(r.panicked)
+			}
+			if !yield(r.input, slices.Values(r.values)) {
+				return
+			}
+		}
+	}
+}
+
+// parallelMap calls f on each of in, up to n at once, and returns the results in order.
+// If f panics, the panic for the earliest element is raised again,
+// and elements after it that have not started are skipped.
+func parallelMap[T, U any](in []T, n int, f func(T) U) []U {
+	rt := make([]U, len(in))
+	panics := make([]any, len(in))
+
+	var failed atomic.Bool
+	var running sync.WaitGroup
+	sem := make(chan struct{}, n)
+	for i, v := range in {
+		sem <- struct{}{}
+		if failed.Load() {
+			break
+		}
+		running.Go(func() {
+			defer func() { <-sem }()
+			defer func() {
+				if r := recover(); r != nil {
+					panics[i] = r
+					failed.Store(true)
+				}
+			}()
+			rt[i] = f(v)
+		})
+	}
+	running.Wait()
+
+	for _, r := range panics {
+		if r != nil {
+			panic(r)
+		}
+	}
+	return rt
+}
+
+// haltMessage formats the value given to halt_error for printing on its own line.
+func haltMessage(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return strings.TrimSuffix(v, "\n")
+	default:
+		return string(must(gojq.Marshal(v)))
+	}
+}
@@ -2,8 +2,13 @@ package jqx
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 	"testing/fstest"
@@ -44,6 +49,12 @@ func TestProgram(t *testing.T) {
 	testRun(t, "[10]", "[\n\t10\n]", &Program{Args: []string{"-t"}})
 	testRun(t, "[10]", "[\n\t10\n]", &Program{Args: []string{"-t", "-j"}})
 
+	testRun(t, "[10]  2", "[[10],2]", &Program{Args: []string{"-s"}})
+	testRun(t, "", "[]", &Program{Args: []string{"-s"}})
+	testRun(t, "a b", `["a","b"]`, &Program{Args: []string{"-s", "-r"}})
+	testRun(t, "[10]  2", "null", &Program{Args: []string{"-n"}})
+	testRun(t, "[10]  2", "{}", &Program{Args: []string{"-n", "$files"}, StdinIsTerminal: true})
+
 	testRun(t, `"a"`, `a`, &Program{})
 	testRun(t, `"a"`, `a`, &Program{StdoutIsTerminal: true})
 	testRun(t, `"a"`, `"a"`, &Program{Args: []string{"-j"}})
@@ -149,3 +160,312 @@ func TestDry(t *testing.T) {
 		assertEqual(t, cat("false.json"), "[\n\tfalse\n]")
 	}
 }
+
+func TestModules(t *testing.T) {
+	dir := t.TempDir()
+	must(0, os.WriteFile(filepath.Join(dir, "m.jq"), []byte(`def twice: .+.;`), 0666))
+	must(0, os.WriteFile(filepath.Join(dir, "d.json"), []byte(`5`), 0666))
+
+	p := Program{}
+	p.Open = toFS(map[string]any{
+		"q.jq":   `include "m"; twice`,
+		"a.json": "[1,2]",
+	}, nil).Open
+
+	p.Args = []string{"-L", dir, `import "m" as m; m::twice`}
+	testRun(t, "1 2", "2 4", &p)
+	p.Args = []string{"-L", dir, `import "d" as $d; $d::d[] + .`}
+	testRun(t, "1 2", "6 7", &p)
+	p.Args = []string{`import "m" as m; m::twice`}
+	testRun(t, "1 2", "error", &p)
+
+	p.Args = []string{"-L", dir, "-f", "q.jq"}
+	testRun(t, "1 2", "2 4", &p)
+	p.Args = []string{"-L", dir, "-f", "q.jq", "a.json"}
+	testRun(t, "3", "6", &p)
+	p.Args = []string{"-f", "missing.jq"}
+	testRun(t, "", "error", &p)
+}
+
+func TestConfig(t *testing.T) {
+	p := Program{Config: fstest.MapFS{
+		"a.jq":    &fstest.MapFile{Data: []byte(`def inc: .+1;`)},
+		"b.jq":    &fstest.MapFile{Data: []byte(`def inc2: inc|inc;`)},
+		"c.notjq": &fstest.MapFile{Data: []byte(`|`)},
+	}}
+	p.Args = []string{"inc2"}
+	testRun(t, "1 2", "3 4", &p)
+	p.Args = []string{"def inc: .+10; inc, inc2"}
+	testRun(t, "1", "11 3", &p)
+
+	p.Config = fstest.MapFS{"a.jq": &fstest.MapFile{Data: []byte(`def inc: ;`)}}
+	testRun(t, "1", "error", &p)
+}
+
+func TestExitStatus(t *testing.T) {
+	code := func(stdin string, args ...string) int {
+		t.Helper()
+		p := Program{Args: args, Println: func(string) {}, Open: toFS(nil, nil).Open}
+		p.Stdin = strings.NewReader(stdin)
+
+		_, err := p.Main()
+		if err == nil {
+			return 0
+		}
+		var exitErr interface{ ExitCode() int }
+		if !errors.As(err, &exitErr) {
+			t.Error("no exit code:", err)
+		}
+		return exitErr.ExitCode()
+	}
+
+	assertEqual(t, code("1"), 0)
+	assertEqual(t, code("[}"), 2)
+	assertEqual(t, code("1", "|"), 3)
+	assertEqual(t, code("1", "maybe"), 3)
+	assertEqual(t, code("1", "error"), 5)
+	assertEqual(t, code("1", ".", "missing.json"), 2)
+
+	assertEqual(t, code("null", "."), 0)
+	assertEqual(t, code("null", "--exit-status", "."), 1)
+	assertEqual(t, code("false", "--exit-status", "."), 1)
+	assertEqual(t, code("1 false 0", "--exit-status", "."), 0)
+	assertEqual(t, code("1", "--exit-status", "empty"), 4)
+
+	assertEqual(t, code("1", "halt"), 0)
+	assertEqual(t, code("1", "halt_error"), 5)
+	assertEqual(t, code("1", "halt_error(0)"), 0)
+	assertEqual(t, code("1", "halt_error(9)"), 9)
+	assertEqual(t, code("false", "--exit-status", "., halt"), 0)
+}
+func TestHalt(t *testing.T) {
+	testRun(t, "1 2 3", "1 2", &Program{Args: []string{"if . == 3 then halt else . end"}})
+	testRun(t, "1 2 3", "error", &Program{Args: []string{`if . == 3 then "bye\n" | halt_error else . end`}})
+
+	p := Program{Args: []string{`"bye\n" | halt_error`}, Stdin: strings.NewReader("1")}
+	_, err := p.Main()
+	assertEqual(t, err.Error(), "bye")
+	p = Program{Args: []string{`{a:1} | halt_error`}, Stdin: strings.NewReader("1")}
+	_, err = p.Main()
+	assertEqual(t, err.Error(), `{"a":1}`)
+
+	fsys := testRun(t, "1 2", "1", &Program{Args: []string{`snapshot("a";.), halt`}})
+	assertEqual(t, string(must(fs.ReadFile(fsys, "a"))), "1")
+}
+
+func TestKeepGoing(t *testing.T) {
+	var errs []string
+	p := Program{Eprintln: func(s string) { errs = append(errs, s) }}
+
+	p.Args = []string{"1 / ."}
+	testRun(t, "1\n0\n[}\n4", "error", &p)
+	assertEqual(t, len(errs), 0)
+
+	p.Args = []string{"-k", "1 / ."}
+	p.Stdin = strings.NewReader("1\n0\n[}\n4")
+	var got []string
+	p.Println = func(s string) { got = append(got, s) }
+	_, err := p.Main()
+	assertString(t, got, `[1 0.25]`)
+	assertString(t, err, `2 errors skipped`)
+	assertEqual(t, len(errs), 2)
+	assertEqual(t, strings.Contains(errs[0], "cannot divide"), true)
+	assertEqual(t, strings.Contains(errs[1], "stdin:3:2"), true)
+
+	errs = nil
+	p.Stdin = strings.NewReader("1\n0\n4")
+	_, err = p.Main()
+	assertString(t, err, `1 error skipped`)
+
+	errs = nil
+	p.Args = []string{"-k", "."}
+	testRun(t, "1 2", "1 2", &p)
+	assertEqual(t, len(errs), 0)
+}
+func TestErrorTypes(t *testing.T) {
+	run := func(stdin string, args ...string) error {
+		p := Program{Args: args, Println: func(string) {}, Open: toFS(nil, nil).Open}
+		p.Stdin = strings.NewReader(stdin)
+		_, err := p.Main()
+		return err
+	}
+
+	var parseErr *QueryParseError
+	assertEqual(t, errors.As(run("1", ". | |"), &parseErr), true)
+	assertEqual(t, parseErr.Offset, 4)
+
+	var decodeErr *DecodeError
+	assertEqual(t, errors.As(run("1\n [}"), &decodeErr), true)
+	assertString(t, []any{decodeErr.File, decodeErr.Line, decodeErr.Column, decodeErr.Offset}, `[stdin 2 3 4]`)
+
+	var runtimeErr *RuntimeError
+	assertEqual(t, errors.As(run("1", "error([.])"), &runtimeErr), true)
+	assertString(t, runtimeErr.Value, `[1]`)
+
+	var pathErr *fs.PathError
+	assertEqual(t, errors.As(run("1", ".", "missing.json"), &pathErr), true)
+	assertEqual(t, pathErr.Path, "missing.json")
+
+	assertEqual(t, errors.As(run("1", "error"), &parseErr), false)
+	assertEqual(t, errors.As(run("1", "error"), &decodeErr), false)
+}
+func TestTimeout(t *testing.T) {
+	testRun(t, "1 2", "error", &Program{Args: []string{"--timeout", "10ms", "last(repeat(.))"}})
+	testRun(t, "1 2", "1 2", &Program{Args: []string{"--timeout", "10s", "."}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p := Program{Context: ctx, Args: []string{"-k", "."}, Stdin: strings.NewReader("1"), Println: func(string) {}}
+	_, err := p.Main()
+	assertEqual(t, errors.Is(err, context.Canceled), true)
+}
+func TestInputLimit(t *testing.T) {
+	p := Program{Limits: Limits{InputBytes: 8}}
+	testRun(t, "[1,2,3]", "[1,2,3]", &p)
+	testRun(t, "[1,2,3,4]", "error", &p)
+	testRun(t, "1 2 3 4 5", "error", &p)
+	p.Args = []string{"-r"}
+	testRun(t, "a b c d", "a b c d", &p)
+	testRun(t, "a b c d e", "error", &p)
+
+	p.Open = toFS(map[string]any{"a.json": "[1,2,3,4]"}, nil).Open
+	p.StdinIsTerminal = true
+	p.Args = []string{".", "a.json"}
+	_, err := p.Main()
+	var limitErr *LimitError
+	assertEqual(t, errors.As(err, &limitErr), true)
+	assertEqual(t, limitErr.Max, 8)
+}
+func TestSetup(t *testing.T) {
+	p := Program{Args: []string{"twice"}, Setup: func(s *State) {
+		s.Define("twice", 0, 0, func(v any, _ []any) any { return []any{v, v} })
+	}}
+	testRun(t, "1", "[1,1]", &p)
+}
+func TestParallel(t *testing.T) {
+	const q = `snapshot("\(.)"; .) | [range(.)] | length`
+	for _, n := range []string{"1", "2", "3", "16"} {
+		in := strings.TrimSpace(strings.Repeat("10 1 4 100 0 ", 10))
+		fsys := testRun(t, in, in, &Program{Args: []string{"-P", n, q}})
+		assertString(t, must(fs.Glob(fsys, "*")), `[0 1 10 100 4]`)
+
+		testRun(t, "1 2 [} 3", "error", &Program{Args: []string{"-P", n, "."}})
+		testRun(t, "1 2 0 3", "error", &Program{Args: []string{"-P", n, "1 / ."}})
+		testRun(t, "1 2 3 4", "1 2", &Program{Args: []string{"-P", n, "if . == 3 then halt end"}})
+		testRun(t, "1 2 3 4", "error", &Program{Args: []string{"-P", n, "--timeout", "50ms", "if . == 2 then last(repeat(.)) end"}})
+
+		// Snapshots are saved in input order, and not after a halt
+		in = strings.Repeat("1 2 3 ", 50) + "4"
+		fsys = testRun(t, in, "4", &Program{Args: []string{"-P", n, `snapshot("out"; .) | select(. == 4)`}})
+		assertString(t, string(must(fs.ReadFile(fsys, "out"))), "4")
+		testRun(t, "1 2 3 4 5", "1 f1", &Program{Args: []string{"-P", n, "--dry-run", `if . == 2 then halt else snapshot("f\(.)"; .) end`}})
+
+		var errs []string
+		p := Program{Args: []string{"-k", "-P", n, "1 / ."}, Eprintln: func(s string) { errs = append(errs, s) }}
+		testRun(t, "1 [} 2 0 4", "error", &p)
+		p.Stdin = strings.NewReader("1\n[}\n2\n0\n4")
+		var got []string
+		p.Println = func(s string) { got = append(got, s) }
+		p.Main()
+		assertString(t, got, `[1 0.5 0.25]`)
+	}
+}
+func TestLoadFiles(t *testing.T) {
+	testFiles := map[string]any{}
+	var names []string
+	for i := range 100 {
+		name := fmt.Sprintf("%02d.json", i)
+		testFiles[name] = fmt.Sprint(i)
+		names = append(names, name)
+	}
+	testFiles["bad1.json"] = "[}"
+	testFiles["bad2.json"] = "1 {]"
+
+	p := Program{Open: toFS(testFiles, nil).Open, StdinIsTerminal: true}
+	p.Args = append([]string{`[.[]] == [range(100)]`}, names...)
+	testRun(t, "", "true", &p)
+	p.Args = append([]string{`[$files | to_entries[] | select(.key != "\(.value + 100)"[1:] + ".json")] | length`}, names...)
+	testRun(t, "", "0", &p)
+
+	for range 10 {
+		p.Args = slices.Concat([]string{"."}, names[:50], []string{"bad1.json", "missing.json", "bad2.json"}, names[50:])
+		p.Stdin = strings.NewReader("")
+		_, err := p.Main()
+		var derr *DecodeError
+		if !errors.As(err, &derr) || derr.File != "bad1.json" {
+			t.Fatal(err)
+		}
+	}
+
+	var errs []string
+	p.Eprintln = func(s string) { errs = append(errs, s) }
+	p.Args = slices.Concat([]string{"-k", "length"}, names[:50], []string{"bad2.json", "bad1.json"}, names[50:])
+	testRun(t, "", "error", &p)
+	assertEqual(t, len(errs), 2)
+	assertEqual(t, strings.Contains(errs[0], "bad2.json"), true)
+	assertEqual(t, strings.Contains(errs[1], "bad1.json"), true)
+}
+func TestPreserveOrder(t *testing.T) {
+	const manifest = `{"name":"x","version":"1.0","id":12345678901234567890,"deps":{"z":1,"a":2}}`
+	testRun(t, manifest, `{"deps":{"a":2,"z":1},"id":12345678901234567890,"name":"x","version":"1.0"}`, &Program{Args: []string{"-j", "."}})
+	testRun(t, manifest, manifest, &Program{Args: []string{"-j", "--preserve-order", "."}})
+	testRun(t, manifest, `{"name":"x","version":"1.1","id":12345678901234567890,"deps":{"z":1,"a":2},"new":true}`,
+		&Program{Args: []string{"-j", "--preserve-order", `.version = "1.1" | .new = true`}})
+
+	p := Program{
+		Args:            []string{"--preserve-order", `snapshot("out.json"; $files["m.json"] | .version = "2.0") | length`, "m.json"},
+		StdinIsTerminal: true,
+		Open:            toFS(map[string]any{"m.json": manifest}, nil).Open,
+	}
+	fsys := testRun(t, "", "1", &p)
+	assertEqual(t, string(must(fs.ReadFile(fsys, "out.json"))), `{"name":"x","version":"2.0","id":12345678901234567890,"deps":{"z":1,"a":2}}`)
+
+	// Each object keeps its own order, even where they share keys
+	const nested = `{"b":1,"c":{"a":1,"b":2}}`
+	testRun(t, nested, nested, &Program{Args: []string{"-j", "--preserve-order", "."}})
+	testRun(t, nested, `{"a":1,"b":2,"x":3}`, &Program{Args: []string{"-j", "--preserve-order", ".c | .x = 3"}})
+	// Built objects take the order of the keys as read, not as built
+	testRun(t, nested, `{"b":1,"c":{"a":1,"b":2}}`, &Program{Args: []string{"-j", "--preserve-order", "{c, b}"}})
+	p = Program{
+		Args: []string{"-j", "--preserve-order", ". + $files", "z.json"},
+		Open: toFS(map[string]any{"z.json": `{"z":{"y":1,"x":2}}`}, nil).Open,
+	}
+	testRun(t, `{"x":1,"y":2}`, `{"x":1,"y":2,"z.json":{"z":{"y":1,"x":2}}}`, &p)
+
+	// Objects of earlier inputs are forgotten, without losing those of later ones
+	in := strings.TrimSpace(strings.Repeat(nested+` {"c":{"b":2,"a":1}} `, 20))
+	for _, n := range []string{"1", "4"} {
+		testRun(t, in, in, &Program{Args: []string{"-j", "--preserve-order", "-P", n, "."}})
+	}
+}
+func TestOutputFormat(t *testing.T) {
+	run := func(stdin string, args ...string) string {
+		t.Helper()
+		var got strings.Builder
+		p := Program{Args: args, Stdin: strings.NewReader(stdin), Print: func(s string) { got.WriteString(s) }}
+		_, err := p.Main()
+		if err != nil {
+			return "error"
+		}
+		return got.String()
+	}
+
+	const obj = `{"b":[1],"a":"é😀"}`
+	const in = obj + ` "x"`
+	assertEqual(t, run(in, "-j", "."), "{\"a\":\"é😀\",\"b\":[1]}\n\"x\"\n")
+	assertEqual(t, run(in, "-j", "--indent", "2", "."), "{\n  \"a\": \"é😀\",\n  \"b\": [\n    1\n  ]\n}\n\"x\"\n")
+	assertEqual(t, run(in, "-j", "-t", "--indent", "0", "."), "{\"a\":\"é😀\",\"b\":[1]}\n\"x\"\n")
+	assertEqual(t, run(in, "-j", "--preserve-order", "."), "{\"b\":[1],\"a\":\"é😀\"}\n\"x\"\n")
+	assertEqual(t, run(in, "-j", "--preserve-order", "--sort-keys", "."), "{\"a\":\"é😀\",\"b\":[1]}\n\"x\"\n")
+	assertEqual(t, run(obj, "--ascii-output", ".a"), "\"\\u00e9\\ud83d\\ude00\"\n")
+	assertEqual(t, run(obj, "--join-output", ".a"), "é😀")
+	assertEqual(t, run(obj, "--join-output", "-j", ".a, .b"), "\"é😀\"[1]")
+	assertEqual(t, run(obj, "--raw-output0", ".a, .b"), "é😀\x00[1]\x00")
+	assertEqual(t, run(`"a\u0000b"`, "--raw-output0", "."), "error")
+	assertEqual(t, run(`"a\u0000b"`, "--raw-output0", "-j", "."), "\"a\\u0000b\"\x00")
+	assertEqual(t, run(obj, "--seq", ".b"), "\x1e[1]\n")
+
+	p := Program{Args: []string{"--indent", "1", "--ascii-output", `snapshot("f"; .) | 1`}}
+	fsys := testRun(t, `{"a":["é"]}`, "1", &p)
+	assertEqual(t, string(must(fs.ReadFile(fsys, "f"))), "{\n \"a\": [\n  \"\\u00e9\"\n ]\n}")
+}
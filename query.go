@@ -1,6 +1,7 @@
 package jqx
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
@@ -10,9 +11,12 @@ import (
 	"fmt"
 	"hash"
 	"iter"
+	"maps"
 	"math/rand/v2"
+	"reflect"
 	"slices"
 	"strings"
+	"sync"
 
 	"github.com/itchyny/gojq"
 )
@@ -33,7 +37,25 @@ var builtins = must(gojq.Parse(`
 	;
 `)).FuncDefs
 
-type constString string
+func init() {
+	// def snapshot($name; $value): snapshot($run; $name; $value);
+	builtins = append(builtins, &gojq.FuncDef{
+		Name: "snapshot",
+		Args: []string{"$name", "$value"},
+		Body: termQuery(callTerm(snapshotFunc, termQuery(callTerm(runVar)), termQuery(callTerm("$name")), termQuery(callTerm("$value")))),
+	})
+}
+
+// Builtins lists the functions jqx defines in jq, as name/arity.
+// Unlike those defined in Go, they are not listed by jq's builtins.
+func Builtins() []string {
+	var rt []string
+	for _, def := range builtins {
+		rt = append(rt, fmt.Sprintf("%s/%d", def.Name, len(def.Args)))
+	}
+	return rt
+}
+
 type FanOut func(any) iter.Seq[any]
 
 type sliceIter[T any] []T
@@ -72,20 +94,73 @@ func iterTest(input any, _ []any) gojq.Iter {
 }
 
 type State struct {
-	Files   map[string]any
+	// Files holds the values saved by snapshot, keyed by filename.
+	// Queries may save them from several goroutines, so it should not be
+	// accessed while they run.
+	Files map[string]any
+	mu    sync.Mutex
+
+	// Globals are available to queries as $name, and all together as $vars.
+	// Their values may change between runs, but the names they have when
+	// the query is compiled are the only ones available to it.
+	// Values must be of the kinds gojq works with, such as those decoded
+	// by encoding/json, and are never modified, so runs may share them.
 	Globals map[string]any
+
+	// ModulePaths are searched for modules named by import and include.
+	// Paths may start with ~ or $ORIGIN, as in jq.
+	ModulePaths []string
+
+	Limits Limits
+
+	// Context, if set, cancels queries that are still running when it is done.
+	Context context.Context
+
+	// Defs are made available to compiled queries alongside the jqx builtins.
+	Defs []*gojq.FuncDef
+
+	options []gojq.CompilerOption
+}
+
+// fileSave is a file saved by snapshot. Runs yield them among their results,
+// so that they are saved in the order of the results, and not at all
+// if the results are never taken.
+type fileSave struct {
+	name  string
+	value any
 }
 
-func (s *State) snapshot(input any, kv []any) (rt any) {
-	rt = input
-	filename, jsonData := kv[0], kv[1]
+func runSnapshot(input any, args []any) any {
+	run, ok := args[0].(*runArgs)
+	if !ok {
+		return errNotRun
+	}
+	run.saves = append(run.saves, fileSave{args[1].(string), args[2]})
+	return input
+}
 
+func (s *State) save(f fileSave) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.Files == nil {
 		s.Files = map[string]any{}
 	}
-	s.Files[filename.(string)] = jsonData
+	s.Files[f.name] = f.value
+}
 
-	return
+// saving saves the files among results as they are taken, and yields the rest.
+func (s *State) saving(results iter.Seq[any]) iter.Seq[any] {
+	return func(yield func(any) bool) {
+		for v := range results {
+			if f, ok := v.(fileSave); ok {
+				s.save(f)
+				continue
+			}
+			if !yield(v) {
+				return
+			}
+		}
+	}
 }
 func shuffle(input any, seed []any) any {
 	s := fmt.Sprint(seed[0])
@@ -177,31 +252,173 @@ func htmlt(input any, args []any) any {
 	return rt
 }
 
-func (s *State) Compile(code constString) FanOut {
-	parsed, err := gojq.Parse(string(code))
-	failif(err, "parsing query")
+// Define adds a Go function to queries compiled from s afterwards.
+// It is called with the input and minArity to maxArity arguments,
+// and may return an error to fail the query.
+func (s *State) Define(name string, minArity, maxArity int, f func(any, []any) any) {
+	s.options = append(s.options, gojq.WithFunction(name, minArity, maxArity, f))
+}
+
+// DefineIter is like [State.Define], for functions that yield any number of values.
+func (s *State) DefineIter(name string, minArity, maxArity int, f func(any, []any) gojq.Iter) {
+	s.options = append(s.options, gojq.WithIterFunction(name, minArity, maxArity, f))
+}
 
-	builtins := slices.Clone(builtins)
-	parsed.FuncDefs = append(builtins, parsed.FuncDefs...)
+// Compile prepares code to be run against inputs.
+// Errors while running are yielded as a final *RuntimeError value.
+func (s *State) Compile(code string) (FanOut, error) {
+	query, err := s.compileSaves(code)
+	if err != nil {
+		return nil, err
+	}
+	return func(v any) iter.Seq[any] { return s.saving(query(v)) }, nil
+}
 
-	globalKeys := slices.Sorted(func(yield func(string) bool) {
-		for key := range s.Globals {
-			yield("$" + key)
+// compileSaves is like [State.Compile], except that the files saved by snapshot
+// are yielded among the results as fileSaves, for the caller to save when it takes them.
+func (s *State) compileSaves(code string) (FanOut, error) {
+	run, err := s.compile(code)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(v any) iter.Seq[any] {
+		ctx := s.Context
+		if ctx == nil {
+			ctx = context.Background()
 		}
-	})
-	globalValues := slices.Collect(func(yield func(any) bool) {
-		for _, globalKey := range globalKeys {
-			yield(s.Globals[globalKey[1:]])
+		return run(ctx, v, s.Globals)
+	}, nil
+}
+
+// runArgs holds the input and globals of a run.
+// gojq normalizes its input and variables in place on every run,
+// which would race when values are shared between concurrent runs,
+// so they are passed through this instead, which gojq leaves alone.
+// Files saved by snapshot are collected here until the run yields them.
+type runArgs struct {
+	input   any
+	globals map[string]any
+	saves   []fileSave
+}
+
+// The names that pass runArgs through queries. The functions contain spaces,
+// so that queries cannot call them, and compile rejects queries using the variable.
+const (
+	runVar       = "$__jqx"
+	inputFunc    = "_jqx input"
+	globalFunc   = "_jqx global"
+	snapshotFunc = "_jqx snapshot"
+)
+
+var errNotRun = errors.New("jqx internal function called outside of a run")
+
+func runInput(v any, _ []any) any {
+	run, ok := v.(*runArgs)
+	if !ok {
+		return errNotRun
+	}
+	return run.input
+}
+func runGlobal(v any, args []any) any {
+	run, ok := v.(*runArgs)
+	if !ok {
+		return errNotRun
+	}
+	if args[0] == nil {
+		return run.globals
+	}
+	name, _ := args[0].(string)
+	return run.globals[name]
+}
+
+func callTerm(name string, args ...*gojq.Query) *gojq.Term {
+	return &gojq.Term{Type: gojq.TermTypeFunc, Func: &gojq.Func{Name: name, Args: args}}
+}
+func termQuery(term *gojq.Term) *gojq.Query {
+	return &gojq.Query{Term: term}
+}
+
+// bindRun rewrites query to take its input and globals from the run variable:
+//
+//	$run | global("a") as $a | ... | global(null) as $vars | input | (query)
+func bindRun(query *gojq.Query, globals []string) *gojq.Query {
+	body := *query
+	body.Meta, body.Imports = nil, nil
+	rt := &gojq.Query{
+		Left:  termQuery(callTerm(inputFunc)),
+		Op:    gojq.OpPipe,
+		Right: termQuery(&gojq.Term{Type: gojq.TermTypeQuery, Query: &body}),
+	}
+
+	bind := func(name string, arg *gojq.Term) {
+		term := callTerm(globalFunc, termQuery(arg))
+		term.SuffixList = []*gojq.Suffix{{Bind: &gojq.Bind{
+			Patterns: []*gojq.Pattern{{Name: "$" + name}},
+			Body:     rt,
+		}}}
+		rt = termQuery(term)
+	}
+	bind("vars", &gojq.Term{Type: gojq.TermTypeNull})
+	for _, name := range slices.Backward(globals) {
+		bind(name, &gojq.Term{Type: gojq.TermTypeString, Str: &gojq.String{Str: name}})
+	}
+
+	return &gojq.Query{
+		Meta:    query.Meta,
+		Imports: query.Imports,
+		Left:    termQuery(callTerm(runVar)),
+		Op:      gojq.OpPipe,
+		Right:   rt,
+	}
+}
+
+// usesRun reports whether v, part of a parsed query, refers to the run variable.
+func usesRun(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return !v.IsNil() && usesRun(v.Elem())
+	case reflect.Slice:
+		for i := range v.Len() {
+			if usesRun(v.Index(i)) {
+				return true
+			}
 		}
-	})
+	case reflect.Struct:
+		if f, ok := v.Interface().(gojq.Func); ok && f.Name == runVar {
+			return true
+		}
+		for i := range v.NumField() {
+			if usesRun(v.Field(i)) {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	globalKeys = append(globalKeys, "$vars")
-	globalValues = append(globalValues, s.Globals)
+// runner runs a compiled query on an input, with values for its globals.
+type runner func(ctx context.Context, v any, globals map[string]any) iter.Seq[any]
 
-	compiled, err := gojq.Compile(
-		parsed,
+func (s *State) compile(code string) (runner, error) {
+	parsed, err := gojq.Parse(code)
+	if err != nil {
+		return nil, newQueryParseError(code, err)
+	}
+
+	parsed.FuncDefs = slices.Concat(s.Defs, parsed.FuncDefs)
+	if usesRun(reflect.ValueOf(parsed)) {
+		return nil, newQueryParseError(code, errors.New("variable not defined: "+runVar))
+	}
+	parsed.FuncDefs = slices.Concat(builtins, parsed.FuncDefs)
+	parsed = bindRun(parsed, slices.Sorted(maps.Keys(s.Globals)))
+
+	options := []gojq.CompilerOption{
+		gojq.WithVariables([]string{runVar}),
+		gojq.WithFunction(inputFunc, 0, 0, runInput),
+		gojq.WithFunction(globalFunc, 1, 1, runGlobal),
 		gojq.WithIterFunction("_itertest", 0, 0, iterTest),
-		gojq.WithFunction("snapshot", 2, 2, s.snapshot),
+		gojq.WithFunction(snapshotFunc, 3, 3, runSnapshot),
 		gojq.WithFunction("shuffle", 1, 1, shuffle),
 		gojq.WithFunction("md5", 0, 0, hasher(md5.New)),
 		gojq.WithFunction("sha1", 0, 0, hasher(sha1.New)),
@@ -214,27 +431,62 @@ func (s *State) Compile(code constString) FanOut {
 		gojq.WithIterFunction("htmlq", 2, 2, htmlq2),
 		gojq.WithIterFunction("htmltok", 0, 0, htmltok),
 		gojq.WithFunction("htmlt", 1, 1, htmlt),
-		gojq.WithVariables(globalKeys),
-	)
-	failif(err, "compiling query")
+		gojq.WithModuleLoader(gojq.NewModuleLoader(s.ModulePaths)),
+	}
+	options = append(options, s.options...)
 
-	return func(v any) iter.Seq[any] {
+	compiled, err := gojq.Compile(parsed, options...)
+	if err != nil {
+		return nil, newQueryParseError(code, err)
+	}
+
+	return func(ctx context.Context, v any, globals map[string]any) iter.Seq[any] {
 		return func(yield func(any) bool) {
-			iter := compiled.Run(v, globalValues...)
+			ctx := ctx
+			if s.Limits.Steps > 0 {
+				ctx = &stepContext{Context: ctx, max: s.Limits.Steps}
+			}
+			run := &runArgs{input: v, globals: globals}
+			iter := compiled.RunWithContext(ctx, nil, run)
+
+			outputs, size := 0, 0
 
 			for {
 				v, ok := iter.Next()
+				// Files saved on the way to v come before it
+				for _, f := range run.saves {
+					if !yield(f) {
+						return
+					}
+				}
+				run.saves = nil
 				if !ok {
 					break
 				}
 
-				err, _ := v.(error)
-				failif(err, "running query")
+				if err, ok := v.(error); ok {
+					yield(newRuntimeError(err))
+					break
+				}
+
+				outputs++
+				if max := s.Limits.Outputs; max > 0 && outputs > max {
+					yield(newRuntimeError(&LimitError{"outputs", int64(max)}))
+					break
+				}
+				if max := s.Limits.OutputBytes; max > 0 {
+					b, _ := gojq.Marshal(v)
+					size += len(b)
+					if size > max {
+						yield(newRuntimeError(&LimitError{"output bytes", int64(max)}))
+						break
+					}
+				}
 
 				if !yield(v) {
 					break
 				}
 			}
 		}
-	}
+	}, nil
 }
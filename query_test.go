@@ -1,17 +1,23 @@
 package jqx
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"math"
 	"regexp"
 	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/itchyny/gojq"
 	"github.com/myaaaaaaaaa/go-jqx/proptest"
 )
 
 func TestCompile(t *testing.T) {
-	query := new(State).Compile(`range(.)*2+1 | tostring`)
+	query := must(new(State).Compile(`range(.)*2+1 | tostring`))
 	got := slices.Collect(query(3))
 
 	assertString(t, got, `[1 3 5]`)
@@ -26,15 +32,14 @@ func TestCompile(t *testing.T) {
 	assertEqual(t, i, 5)
 }
 func TestSmoke(t *testing.T) {
-	query := new(State).Compile(`_itertest`)
+	query := must(new(State).Compile(`_itertest`))
 	assertString(t, slices.Collect(query("hello.")), `[hello. ello. llo. lo. o. .]`)
 	assertString(t, slices.Collect(query(5)), `[4 3 2 1 0]`)
 }
 func TestError(t *testing.T) {
-	err := func(code string) (rt error) {
-		defer catch[error](&rt)
-		new(State).Compile(constString(code))
-		return nil
+	err := func(code string) error {
+		_, err := new(State).Compile(code)
+		return err
 	}
 
 	assertEqual(t, err("."), nil)
@@ -43,13 +48,20 @@ func TestError(t *testing.T) {
 
 	assertEqual(t, err("|") != nil, true)
 	assertEqual(t, err("maybe") != nil, true)
+
+	// The plumbing that passes inputs and globals is out of reach
+	assertEqual(t, err("1 | _jqx_input") != nil, true)
+	assertEqual(t, err("$__jqx") != nil, true)
+	assertEqual(t, err("def f: $__jqx; 1") != nil, true)
+	assertString(t, runInput(1, nil), errNotRun.Error())
+	assertString(t, runGlobal(1, []any{"a"}), errNotRun.Error())
 }
 func TestState(t *testing.T) {
 	state := State{}
-	query := state.Compile(`
+	query := must(state.Compile(`
 		fromjson | to_entries[] |
 		snapshot(.key;.value+.value) | .key+.key
-	`)
+	`))
 
 	keys := slices.Collect(query(`{"a":"aa", "c":[3], "q":{"e":10}, "r":5}`))
 
@@ -60,7 +72,7 @@ func TestState(t *testing.T) {
 		"k": keys,
 		"v": state.Files,
 	}}
-	query = state.Compile(`$k[],$v[] | tostring`)
+	query = must(state.Compile(`$k[],$v[] | tostring`))
 
 	got := slices.Collect(query(nil))
 	assertString(t, got, `[aa cc qq rr aaaa [3,3] {"e":10} 10]`)
@@ -143,29 +155,29 @@ func TestTrim(t *testing.T) {
 }
 
 func TestHash(t *testing.T) {
-	query := new(State).Compile(`md5`)
+	query := must(new(State).Compile(`md5`))
 	assertString(t, slices.Collect(query("")), `[d41d8cd98f00b204e9800998ecf8427e]`)
 	assertString(t, slices.Collect(query("\n")), `[68b329da9893e34099c7d8ad5cb9c940]`)
 	assertString(t, slices.Collect(query("hi")), `[49f68a5c8493ec2c0bf489821c21fc3b]`)
 
-	query = new(State).Compile(`sha1`)
+	query = must(new(State).Compile(`sha1`))
 	assertString(t, slices.Collect(query("")), `[da39a3ee5e6b4b0d3255bfef95601890afd80709]`)
 	assertString(t, slices.Collect(query("\n")), `[adc83b19e793491b1c6ea0fd8b46cd9f32e592fc]`)
 	assertString(t, slices.Collect(query("hi")), `[c22b5f9178342609428d6f51b2c5af4c0bde6a42]`)
-	query = new(State).Compile(`sha256`)
+	query = must(new(State).Compile(`sha256`))
 	assertString(t, slices.Collect(query("")), `[e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855]`)
 	assertString(t, slices.Collect(query("\n")), `[01ba4719c80b6fe911b091a7c05124b64eeece964e09c058ef8f9805daca546b]`)
 	assertString(t, slices.Collect(query("hi")), `[8f434346648f6b96df89dda901c5176b10a6d83961dd3c1ac88b59b2dc327aa4]`)
-	query = new(State).Compile(`sha512`)
+	query = must(new(State).Compile(`sha512`))
 	assertString(t, slices.Collect(query("")), `[cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e]`)
 	assertString(t, slices.Collect(query("\n")), `[be688838ca8686e5c90689bf2ab585cef1137c999b48c70b92f67a5c34dc15697b5d11c982ed6d71be1e1e7f7b4e0733884aa97c3f7a339a8ed03577cf74be09]`)
 	assertString(t, slices.Collect(query("hi")), `[150a14ed5bea6cc731cf86c41566ac427a8db48ef1b9fd626664b3bfbb99071fa4c922f33dde38719b8c8354e2b7ab9d77e0e67fc12843920a712e73d558e197]`)
 }
 func TestShuffle(t *testing.T) {
-	query := new(State).Compile(`range(4) | [range(.)] | [shuffle(range(30))|join("")] | unique | join("-")`)
+	query := must(new(State).Compile(`range(4) | [range(.)] | [shuffle(range(30))|join("")] | unique | join("-")`))
 	assertString(t, slices.Collect(query(nil)), `[ 0 01-10 012-021-102-120-201-210]`)
 
-	query = new(State).Compile(`def seq(f): range(4) | [range(.)] | [shuffle(range(30)|f)]; seq(.),seq(5) | unique | length`)
+	query = must(new(State).Compile(`def seq(f): range(4) | [range(.)] | [shuffle(range(30)|f)]; seq(.),seq(5) | unique | length`))
 	assertString(t, slices.Collect(query(nil)), `[1 1 2 6 1 1 1 1]`)
 }
 func BenchmarkShuffle(b *testing.B) {
@@ -176,14 +188,14 @@ func BenchmarkShuffle(b *testing.B) {
 
 	for _, list := range lists {
 		b.Run(list, func(b *testing.B) {
-			query := new(State).Compile(`
+			query := must(new(State).Compile(`
 				def fac($n): if $n==0 then 1 else $n*fac($n-1) end;
-				. as $n | ` + constString(list) + `
+				. as $n | ` + list + `
 				| reduce shuffle(range($n*fac(length))) as $perm (
 					{};
 					.[$perm|join("")] |= .+1
 				)
-			`)
+			`))
 
 			ss := slices.Collect(query(b.N))
 			assertEqual(b, len(ss), 1)
@@ -200,3 +212,133 @@ func BenchmarkShuffle(b *testing.B) {
 		})
 	}
 }
+func TestQueryError(t *testing.T) {
+	err := func(code string) error {
+		_, err := new(State).Compile(code)
+		var parseErr *QueryParseError
+		assertEqual(t, errors.As(err, &parseErr), true)
+		return err
+	}
+
+	assertString(t, err(". | |"), "unexpected token \"|\"\n    . | |\n        ^")
+	assertString(t, err("[1,"), "unexpected EOF\n    [1,\n       ^")
+	assertString(t, err(".a |\n  maybe(1)"), "function not defined: maybe/1\n      maybe(1)\n      ^")
+	assertString(t, err(". as $xy | $xy, $x"), "variable not defined: $x\n    . as $xy | $xy, $x\n                    ^")
+	assertString(t, err(`import "nothing" as n; .`), `module not found: "nothing"`)
+}
+func TestRuntimeError(t *testing.T) {
+	query := must(new(State).Compile(`1, error({a: .}), 2`))
+	got := slices.Collect(query(5))
+	assertEqual(t, len(got), 2)
+
+	err := got[1].(*RuntimeError)
+	assertString(t, err.Value, `map[a:5]`)
+	assertEqual(t, err.Error(), `error: {"a":5}`)
+
+	query = must(new(State).Compile(`1 / .`))
+	err = slices.Collect(query(0))[0].(*RuntimeError)
+	assertString(t, err.Value, err.Error())
+}
+func TestContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	state := State{Context: ctx}
+	query := must(state.Compile(`repeat(.)`))
+
+	n := 0
+	for v := range query(1) {
+		if err, ok := v.(*RuntimeError); ok {
+			assertEqual(t, errors.Is(err, context.Canceled), true)
+			break
+		}
+		n++
+		if n == 100 {
+			cancel()
+		}
+	}
+	assertEqual(t, n, 100)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	state.Context = ctx
+	query = must(state.Compile(`def f: f; f`))
+	got := slices.Collect(query(nil))
+	assertEqual(t, errors.Is(got[0].(error), context.DeadlineExceeded), true)
+}
+func TestLimits(t *testing.T) {
+	run := func(limits Limits, code string, input any) string {
+		query := must((&State{Limits: limits}).Compile(code))
+		got := slices.Collect(query(input))
+		if err, ok := got[len(got)-1].(error); ok {
+			var limitErr *LimitError
+			assertEqual(t, errors.As(err, &limitErr), true)
+			return fmt.Sprint(len(got)-1, " ", limitErr.Limit)
+		}
+		return fmt.Sprint(len(got))
+	}
+
+	assertEqual(t, run(Limits{}, `range(.)`, 100), "100")
+	assertEqual(t, run(Limits{Outputs: 100}, `range(.)`, 100), "100")
+	assertEqual(t, run(Limits{Outputs: 10}, `range(.)`, 100), "10 outputs")
+	assertEqual(t, run(Limits{Outputs: 10}, `repeat(.)`, 1), "10 outputs")
+
+	assertEqual(t, run(Limits{OutputBytes: 10}, `"abcdefgh"`, nil), "1")
+	assertEqual(t, run(Limits{OutputBytes: 10}, `"abcdefghi"`, nil), "0 output bytes")
+	assertEqual(t, run(Limits{OutputBytes: 10}, `range(.)`, 100), "10 output bytes")
+
+	assertEqual(t, run(Limits{Steps: 1000}, `range(.)`, 10), "10")
+	assertEqual(t, run(Limits{Steps: 1000}, `[range(.)]`, 1000), "0 steps")
+	assertEqual(t, run(Limits{Steps: 1000}, `def f: 1 + f; f`, nil), "0 steps")
+
+	query := must((&State{Limits: Limits{Outputs: 2}}).Compile(`range(.)`))
+	assertString(t, slices.Collect(query(2)), `[0 1]`)
+	assertString(t, slices.Collect(query(2)), `[0 1]`)
+}
+func TestBuiltins(t *testing.T) {
+	names := Builtins()
+	assertEqual(t, slices.Contains(names, "fields/2"), true)
+	assertEqual(t, slices.Contains(names, "shuffle/0"), true)
+	assertEqual(t, slices.Contains(names, "shuffle/1"), false)
+}
+func TestDefine(t *testing.T) {
+	state := State{}
+	state.Define("lookup", 1, 2, func(v any, args []any) any {
+		if len(args) == 2 {
+			return fmt.Errorf("no %v", args[1])
+		}
+		return fmt.Sprint(v, "=", args[0])
+	})
+	state.DefineIter("chars", 0, 0, func(v any, _ []any) gojq.Iter {
+		return gojq.NewIter(slices.Collect(func(yield func(any) bool) {
+			for _, c := range v.(string) {
+				yield(string(c))
+			}
+		})...)
+	})
+
+	query := must(state.Compile(`lookup(1), [chars], (try lookup(1; 2) catch .), sha1[:4], snapshot("f"; 1)`))
+	assertString(t, slices.Collect(query("abc")), `[abc=1 [a b c] no 2 a999 abc]`)
+	assertString(t, state.Files, `map[f:1]`)
+
+	query = must(state.Compile(`lookup(1; 2)`))
+	err := slices.Collect(query("abc"))[0].(*RuntimeError)
+	assertEqual(t, err.Error(), "no 2")
+
+	_, err2 := state.Compile(`lookup`)
+	assertEqual(t, err2 != nil, true)
+}
+func TestSharedValues(t *testing.T) {
+	shared := map[string]any{"a": []any{1.0, map[string]any{"b": 2.0}}}
+	state := State{Globals: map[string]any{"s": shared}}
+	query := must(state.Compile(`([path(..)] | length), ($s | .a[1].b += 1 | tojson), (.a |= 5 | tojson)`))
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			for range 100 {
+				assertString(t, slices.Collect(query(shared)), `[5 {"a":[1,{"b":3}]} {"a":5}]`)
+			}
+		})
+	}
+	wg.Wait()
+	assertString(t, shared, `map[a:[1 map[b:2]]]`)
+}
@@ -1,15 +1,40 @@
 package jqx
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/fs"
+	"strings"
 	"testing/fstest"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
-type failError string
+// Exit statuses, following jq.
+const (
+	exitFalsy   = 1
+	exitSystem  = 2
+	exitCompile = 3
+	exitEmpty   = 4
+	exitRuntime = 5
+)
+
+type failError struct {
+	msg  string
+	code int
+	err  error
+}
 
-func (f failError) Error() string { return string(f) }
+func (f failError) Error() string { return f.msg }
+func (f failError) Unwrap() error { return f.err }
+
+// ExitCode reports the process exit status appropriate for the error,
+// in the same manner as [gojq.HaltError].
+func (f failError) ExitCode() int { return f.code }
+
+// haltError stops all further processing of inputs.
+type haltError struct{ failError }
 
 func must[T any](val T, err error) T {
 	if err != nil {
@@ -18,13 +43,18 @@ func must[T any](val T, err error) T {
 	return val
 }
 func failif(err error, format string, args ...any) {
+	failcode(exitSystem, err, format, args...)
+}
+func failcode(code int, err error, format string, args ...any) {
 	if err == nil {
 		return
 	}
-
+	panic(failErrorf(code, err, format, args...))
+}
+func failErrorf(code int, err error, format string, args ...any) failError {
 	s := fmt.Sprintf(format, args...)
 	s = fmt.Sprintf("error while %s: %v", s, err)
-	panic(failError(s))
+	return failError{s, code, err}
 }
 func catch[T error](rt *error) {
 	err := recover()
@@ -37,23 +67,134 @@ func catch[T error](rt *error) {
 	}
 }
 
-func getMarshaler(tab bool, str bool) func(v any) []byte {
-	return func(v any) []byte {
-		if str {
-			if v, ok := v.(string); ok {
-				return []byte(v)
-			}
+// pointAt quotes the line of text containing offset, with a caret underneath.
+func pointAt(text string, offset int) string {
+	offset = min(offset, len(text))
+	start := strings.LastIndexByte(text[:offset], '\n') + 1
+	end := strings.IndexByte(text[offset:], '\n')
+	if end < 0 {
+		end = len(text)
+	} else {
+		end += offset
+	}
+
+	caret := strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return r
 		}
+		return ' '
+	}, text[start:offset])
+
+	return "    " + text[start:end] + "\n    " + caret + "^"
+}
+
+type format struct {
+	// indent is repeated for each level of nesting.
+	// If it is empty, output is compact.
+	indent string
+	str    bool
+	// ascii escapes characters outside of ASCII.
+	ascii bool
+
+	// order, if set, orders object keys instead of sorting them.
+	order *keyOrder
+}
 
-		if tab {
-			return must(json.MarshalIndent(v, "", "\t"))
+func (f format) marshal(v any) ([]byte, error) {
+	if f.str && !f.ascii {
+		if v, ok := v.(string); ok {
+			return []byte(v), nil
 		}
-		return must(json.Marshal(v))
+	}
+
+	var b []byte
+	var err error
+	if f.order != nil {
+		var buf bytes.Buffer
+		err = encodeOrdered(&buf, v, f.order)
+		b = buf.Bytes()
+	} else {
+		b, err = json.Marshal(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if f.indent != "" {
+		var buf bytes.Buffer
+		json.Indent(&buf, b, "", f.indent)
+		b = buf.Bytes()
+	}
+	if f.ascii {
+		b = escapeNonASCII(b)
+	}
+	return b, nil
+}
+
+// escapeNonASCII replaces the characters outside of ASCII in JSON text with \u escapes,
+// which is safe because they only occur in strings.
+func escapeNonASCII(b []byte) []byte {
+	var buf bytes.Buffer
+	for _, r := range string(b) {
+		switch {
+		case r < utf8.RuneSelf:
+			buf.WriteByte(byte(r))
+		case r > 0xffff:
+			r1, r2 := utf16.EncodeRune(r)
+			fmt.Fprintf(&buf, `\u%04x\u%04x`, r1, r2)
+		default:
+			fmt.Fprintf(&buf, `\u%04x`, r)
+		}
+	}
+	return buf.Bytes()
+}
+
+// encodeOrdered is like json.Marshal, with object keys ordered by order.
+func encodeOrdered(buf *bytes.Buffer, v any, order *keyOrder) error {
+	switch v := v.(type) {
+	case map[string]any:
+		buf.WriteByte('{')
+		for i, k := range order.sorted(v) {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(k)
+			buf.Write(key)
+			buf.WriteByte(':')
+			if err := encodeOrdered(buf, v[k], order); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []any:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeOrdered(buf, e, order); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	return nil
+}
+
+func getMarshaler(f format) func(v any) []byte {
+	return func(v any) []byte {
+		return must(f.marshal(v))
 	}
 }
 func toFS(m map[string]any, marshaler func(any) []byte) fs.FS {
 	if marshaler == nil {
-		marshaler = getMarshaler(false, true)
+		marshaler = getMarshaler(format{str: true})
 	}
 
 	rt := fstest.MapFS{}
@@ -16,3 +16,11 @@ func assertString(t *testing.T, got any, want string) {
 	t.Helper()
 	assertEqual(t, fmt.Sprint(got), want)
 }
+
+func TestPointAt(t *testing.T) {
+	assertEqual(t, pointAt(". | |", 4), "    . | |\n        ^")
+	assertEqual(t, pointAt(". | |", 5), "    . | |\n         ^")
+	assertEqual(t, pointAt("a\n\tbc\nd", 3), "    \tbc\n    \t^")
+	assertEqual(t, pointAt("a\n\tbc\nd", 7), "    d\n     ^")
+	assertEqual(t, pointAt("é|", 2), "    é|\n     ^")
+}